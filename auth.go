@@ -0,0 +1,86 @@
+package spm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// Roles of remote clients, each may do what the ones below it may.
+const (
+	// RoleAdmin may do everything, including starting new commands.
+	RoleAdmin = "admin"
+	// RoleOperator may stop, restart, scale and rotate started tasks.
+	RoleOperator = "operator"
+	// RoleViewer may list tasks and read their status, processes, logs and
+	// events.
+	RoleViewer = "viewer"
+)
+
+// ValidRole reports whether role is a known role.
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleOperator || role == RoleViewer
+}
+
+// RoleAllows reports whether a client with role may send requests of method.
+func RoleAllows(role, method string) bool {
+	switch method {
+	case MethodList, MethodStatus, MethodPs, MethodLog, MethodGrep, MethodEvents, MethodCancel:
+		return role == RoleViewer || role == RoleOperator || role == RoleAdmin
+	case MethodStop, MethodRestart, MethodScale, MethodRotate:
+		return role == RoleOperator || role == RoleAdmin
+	}
+	return role == RoleAdmin
+}
+
+// LoadServerTLS returns the TLS configuration of a daemon that listens with
+// the certificate in certFile and keyFile, and accepts clients with a
+// certificate signed by the CAs in caFile only.
+func LoadServerTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCAs(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// LoadClientTLS returns the TLS configuration of a client that presents the
+// certificate in certFile and keyFile, and trusts daemons with a
+// certificate signed by the CAs in caFile.
+func LoadClientTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCAs(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func loadCAs(filename string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %s", filename)
+	}
+	return pool, nil
+}
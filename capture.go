@@ -0,0 +1,113 @@
+package spm
+
+import (
+	"bytes"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults of capturing the output of tasks.
+const (
+	// DefaultMaxLine is the length in bytes after which lines are split.
+	DefaultMaxLine = 64 * 1024
+	// DefaultFlushPartial is how long output without a trailing newline
+	// is held back before it is logged as a line of its own.
+	DefaultFlushPartial = time.Second
+)
+
+// splitLines reads in and passes its lines to fn without the line ending.
+// Lines longer than max bytes are split, output that doesn't end with a
+// newline is passed on once it has waited for flush, unless flush is 0.
+// Reaching the end of in isn't an error.
+func splitLines(in io.Reader, max int, flush time.Duration, fn func([]byte)) error {
+	if max <= 0 {
+		max = DefaultMaxLine
+	}
+
+	chunks := make(chan []byte)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := in.Read(buf)
+			if n > 0 {
+				chunks <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				if err != io.EOF {
+					errc <- err
+				}
+				return
+			}
+		}
+	}()
+
+	var (
+		pending []byte
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				if len(pending) > 0 {
+					fn(pending)
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				select {
+				case err := <-errc:
+					return err
+				default:
+					return nil
+				}
+			}
+			pending = append(pending, chunk...)
+			off := 0
+		lines:
+			for {
+				rest := pending[off:]
+				i := bytes.IndexByte(rest, '\n')
+				switch {
+				case i >= 0 && i <= max:
+					fn(bytes.TrimSuffix(rest[:i], []byte{'\r'}))
+					off += i + 1
+				case len(rest) > max:
+					n := splitPoint(rest, max)
+					fn(rest[:n])
+					off += n
+				default:
+					break lines
+				}
+			}
+			pending = pending[:copy(pending, pending[off:])]
+			switch {
+			case len(pending) == 0 && timer != nil:
+				timer.Stop()
+				timer, timeout = nil, nil
+			case len(pending) > 0 && timer == nil && flush > 0:
+				timer = time.NewTimer(flush)
+				timeout = timer.C
+			}
+		case <-timeout:
+			fn(pending)
+			pending = pending[:0]
+			timer, timeout = nil, nil
+		}
+	}
+}
+
+// splitPoint returns where to split a line longer than max bytes without
+// cutting a UTF-8 encoded rune into two.
+func splitPoint(line []byte, max int) int {
+	for n := max; n > max-utf8.UTFMax && n > 0; n-- {
+		if utf8.RuneStart(line[n]) {
+			return n
+		}
+	}
+	return max
+}
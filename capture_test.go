@@ -0,0 +1,54 @@
+package spm
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitLines(t *testing.T) {
+	var got []string
+	in := strings.NewReader("short\r\n" + strings.Repeat("a", 10) + "\nééé\nno newline")
+	err := splitLines(in, 4, 0, func(line []byte) {
+		got = append(got, string(line))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// é takes two bytes and is never cut
+	want := []string{"shor", "t", "aaaa", "aaaa", "aa", "éé", "é", "no n", "ewli", "ne"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSplitLinesFlushPartial(t *testing.T) {
+	r, w := io.Pipe()
+	lines := make(chan string, 10)
+	go func() {
+		splitLines(r, 0, 20*time.Millisecond, func(line []byte) {
+			lines <- string(line)
+		})
+		close(lines)
+	}()
+
+	w.Write([]byte("progress 10%"))
+	select {
+	case line := <-lines:
+		if line != "progress 10%" {
+			t.Errorf("got %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial line not flushed")
+	}
+	w.Write([]byte(" 20%\n"))
+	w.Close()
+	if line := <-lines; line != " 20%" {
+		t.Errorf("got %q after the partial line", line)
+	}
+	if _, ok := <-lines; ok {
+		t.Error("more lines than written")
+	}
+}
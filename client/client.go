@@ -0,0 +1,226 @@
+// Package client talks to a running spm daemon.
+//
+// Every call opens a connection of its own, canceling its context closes
+// the connection, which cancels the request on the daemon as well.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bytegust/spm"
+)
+
+// DefaultDialTimeout bounds connecting to the daemon unless the context of
+// a call ends earlier.
+const DefaultDialTimeout = 5 * time.Second
+
+// Client is a client of the spm daemon.
+type Client struct {
+	// DialTimeout bounds connecting to the daemon, 0 is DefaultDialTimeout.
+	DialTimeout time.Duration
+	// Host is the TCP address of a remote daemon, empty is the daemon on
+	// this machine.
+	Host string
+	// TLS carries the client certificate for a remote daemon.
+	TLS *tls.Config
+}
+
+// New returns a client of the daemon on this machine.
+func New() *Client {
+	return &Client{DialTimeout: DefaultDialTimeout}
+}
+
+// NewRemote returns a client of the daemon listening on host, see
+// spm.LoadClientTLS for cfg.
+func NewRemote(host string, cfg *tls.Config) *Client {
+	return &Client{DialTimeout: DefaultDialTimeout, Host: host, TLS: cfg}
+}
+
+// IsNotFound reports whether err is about a task the daemon doesn't know.
+func IsNotFound(err error) bool {
+	e, ok := err.(*spm.Error)
+	return ok && e.Code == spm.CodeNotFound
+}
+
+func (c *Client) dial(ctx context.Context) (*spm.Conn, error) {
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var conn *spm.Conn
+	var err error
+	if c.Host != "" {
+		if c.TLS == nil {
+			return nil, fmt.Errorf("no TLS configuration for %s", c.Host)
+		}
+		conn, err = spm.DialTLS(dctx, c.Host, c.TLS)
+	} else {
+		conn, err = spm.DialContext(dctx)
+	}
+	if err != nil {
+		if _, ok := err.(*spm.Error); ok {
+			return nil, err
+		}
+		if c.Host != "" {
+			return nil, fmt.Errorf("can not connect to the spm daemon at %s: %s", c.Host, err)
+		}
+		return nil, fmt.Errorf("can not connect to the spm daemon, is it running? %s", err)
+	}
+	return conn, nil
+}
+
+// stream sends a request and passes its results to fn until the last one.
+func (c *Client) stream(ctx context.Context, method string, params interface{}, fn func(json.RawMessage) error) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err = conn.Stream(method, params, nil, fn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// call sends a request and decodes its result into result, unless it is nil.
+func (c *Client) call(ctx context.Context, method string, params, result interface{}) error {
+	return c.stream(ctx, method, params, func(raw json.RawMessage) error {
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(raw, result)
+	})
+}
+
+// Start starts the tasks of the Procfile at procfile, an absolute path, or
+// the listed ones only, and returns once they have been started.
+func (c *Client) Start(ctx context.Context, procfile string, tasks ...string) error {
+	return c.call(ctx, spm.MethodStart, spm.StartParams{Procfile: procfile, Tasks: tasks}, nil)
+}
+
+// StartJobs starts tasks as they are, e.g. read from a Procfile the daemon
+// can't read itself.
+func (c *Client) StartJobs(ctx context.Context, tasks []spm.Task) error {
+	return c.call(ctx, spm.MethodStart, spm.StartParams{Jobs: tasks}, nil)
+}
+
+// Stop stops the tasks, all of them if none are given, and returns once
+// they have ended.
+func (c *Client) Stop(ctx context.Context, tasks ...string) error {
+	return c.call(ctx, spm.MethodStop, spm.StopParams{Tasks: tasks}, nil)
+}
+
+// Restart stops the tasks and starts them again.
+func (c *Client) Restart(ctx context.Context, tasks ...string) error {
+	return c.call(ctx, spm.MethodRestart, spm.RestartParams{Tasks: tasks}, nil)
+}
+
+// Scale runs count instances of task.
+func (c *Client) Scale(ctx context.Context, task string, count int) error {
+	return c.call(ctx, spm.MethodScale, spm.ScaleParams{Task: task, Count: count}, nil)
+}
+
+// List returns the names of the running tasks.
+func (c *Client) List(ctx context.Context) ([]string, error) {
+	var res spm.ListResult
+	err := c.call(ctx, spm.MethodList, nil, &res)
+	return res.Tasks, err
+}
+
+// Status returns the status of the tasks, of all started ones if none are
+// given.
+func (c *Client) Status(ctx context.Context, tasks ...string) ([]spm.TaskStatus, error) {
+	var res spm.StatusResult
+	err := c.call(ctx, spm.MethodStatus, spm.StatusParams{Tasks: tasks}, &res)
+	return res.Tasks, err
+}
+
+// Processes returns the process trees of the tasks, of all running ones if
+// none are given.
+func (c *Client) Processes(ctx context.Context, tasks ...string) ([]spm.ProcessInfo, error) {
+	var res spm.PsResult
+	err := c.call(ctx, spm.MethodPs, spm.PsParams{Tasks: tasks}, &res)
+	return res.Processes, err
+}
+
+// Save snapshots the running tasks into file, or the default dump file if
+// file is empty.
+func (c *Client) Save(ctx context.Context, file string) error {
+	return c.call(ctx, spm.MethodSave, spm.SaveParams{File: file}, nil)
+}
+
+// Resurrect starts the tasks saved into file by Save.
+func (c *Client) Resurrect(ctx context.Context, file string) error {
+	return c.call(ctx, spm.MethodResurrect, spm.SaveParams{File: file}, nil)
+}
+
+// Rotate rotates the log files of the tasks.
+func (c *Client) Rotate(ctx context.Context, tasks ...string) error {
+	return c.call(ctx, spm.MethodRotate, spm.RotateParams{Tasks: tasks}, nil)
+}
+
+// Logs returns the last lines of the logs selected by p, interleaved in
+// time order. p.Follow is ignored, see Subscribe.
+func (c *Client) Logs(ctx context.Context, p spm.LogParams) ([]spm.LogLine, error) {
+	p.Follow = false
+	var res spm.LogResult
+	err := c.call(ctx, spm.MethodLog, p, &res)
+	return res.Lines, err
+}
+
+// Subscribe passes the last lines of the logs selected by p and then every
+// new line to fn, until ctx ends or fn returns an error.
+func (c *Client) Subscribe(ctx context.Context, p spm.LogParams, fn func(spm.LogLine) error) error {
+	p.Follow = true
+	return c.stream(ctx, spm.MethodLog, p, logLines(fn))
+}
+
+// Grep passes the lines of a log search to fn.
+func (c *Client) Grep(ctx context.Context, p spm.GrepParams, fn func(spm.LogLine) error) error {
+	return c.stream(ctx, spm.MethodGrep, p, logLines(fn))
+}
+
+// Events passes the events selected by p to fn as they happen, until ctx
+// ends or fn returns an error.
+func (c *Client) Events(ctx context.Context, p spm.EventsParams, fn func(spm.Event) error) error {
+	return c.stream(ctx, spm.MethodEvents, p, func(raw json.RawMessage) error {
+		var e spm.Event
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
+
+func logLines(fn func(spm.LogLine) error) func(json.RawMessage) error {
+	return func(raw json.RawMessage) error {
+		var res spm.LogResult
+		if err := json.Unmarshal(raw, &res); err != nil {
+			return err
+		}
+		for _, line := range res.Lines {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bytegust/spm"
+)
+
+func fakeDaemon(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "spm-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := spm.SocketPath
+	spm.SocketPath = filepath.Join(dir, "spm.sock")
+	ln, err := spm.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := func(req *spm.Request, res *spm.Responder) {
+		switch req.Method {
+		case spm.MethodStatus:
+			var p spm.StatusParams
+			req.Decode(&p)
+			if len(p.Tasks) > 0 && p.Tasks[0] != "web" {
+				res.Finish(nil, &spm.NotFoundError{Task: p.Tasks[0], Reason: "is not running"})
+				return
+			}
+			res.Finish(spm.StatusResult{Tasks: []spm.TaskStatus{{Name: "web", Pid: 42}}}, nil)
+		case spm.MethodLog:
+			res.Send(spm.LogResult{Tasks: []string{"web"}})
+			res.Send(spm.LogResult{Lines: []spm.LogLine{{Task: "web", Text: "hello"}}})
+			<-res.Done()
+		}
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ln.Serve(c, handle)
+		}
+	}()
+	return func() {
+		ln.Close()
+		spm.SocketPath = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClient(t *testing.T) {
+	defer fakeDaemon(t)()
+	c := New()
+	ctx := context.Background()
+
+	tasks, err := c.Status(ctx)
+	if err != nil || len(tasks) != 1 || tasks[0].Pid != 42 {
+		t.Errorf("status: %v %v", tasks, err)
+	}
+	if _, err := c.Status(ctx, "nope"); !IsNotFound(err) {
+		t.Errorf("status of unknown task: got %v", err)
+	}
+
+	// Subscribe streams until its context ends
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	var lines []spm.LogLine
+	err = c.Subscribe(ctx, spm.LogParams{Tasks: []string{"web"}}, func(line spm.LogLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != context.DeadlineExceeded || len(lines) != 1 || lines[0].Text != "hello" {
+		t.Errorf("subscribe: got %v, error %v", lines, err)
+	}
+}
+
+func TestClientNoDaemon(t *testing.T) {
+	old := spm.SocketPath
+	spm.SocketPath = filepath.Join(os.TempDir(), "spm-no-daemon.sock")
+	defer func() { spm.SocketPath = old }()
+
+	if _, err := New().List(context.Background()); err == nil {
+		t.Error("no error without a daemon")
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/bytegust/spm"
 	"github.com/takama/daemon"
 	"github.com/urfave/cli"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"regexp"
 	"syscall"
+	"time"
 )
 
 const (
@@ -18,7 +23,7 @@ const (
 	description = "Simple Process Manager"
 )
 
-//	dependencies that are NOT required by the service, but might be used
+// dependencies that are NOT required by the service, but might be used
 var dependencies = []string{"dummy.service"}
 
 var stdlog, errlog *log.Logger
@@ -89,25 +94,124 @@ func daemonStatus(ctx *cli.Context) error {
 
 func startDaemon(c *cli.Context) {
 	manager := spm.NewManager()
-	sock := spm.NewSocket()
+	manager.StopTimeout = c.Duration("stop-timeout")
+	manager.LogDir = c.String("log-dir")
+	manager.LogFormat = c.String("log-format")
+	if !spm.ValidLogFormat(manager.LogFormat) {
+		log.Fatalf("unknown log format %s", manager.LogFormat)
+	}
+	manager.LogOutput = c.String("log-output")
+	if !spm.ValidLogOutput(manager.LogOutput) {
+		log.Fatalf("unknown log output %s", manager.LogOutput)
+	}
+
+	// in init mode spm is the entrypoint of a container, it reaps orphans,
+	// mirrors task output to stdout and lives as long as critical tasks do
+	initMode := c.Bool("init")
+	sigchld := make(chan os.Signal, 1)
+	if initMode {
+		if err := spm.SetSubreaper(); err != nil {
+			log.Fatal(err)
+		}
+		spm.NotifyOrphans(sigchld)
+		manager.Mirror = os.Stdout
+		manager.CriticalExit = make(chan int, 1)
+		if manager.StopTimeout == 0 {
+			// container runtimes kill us after 10s anyway
+			manager.StopTimeout = 10 * time.Second
+		}
+	}
+	cfg, err := spm.ReadConfig(c.String("config"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := spm.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// only the daemon that owns the socket takes over the tasks of the
+	// previous one
+	if !initMode {
+		manager.StateFile = spm.DefaultStateFile()
+		if err := manager.Restore(context.Background()); err != nil {
+			log.Println("restore state:", err)
+		}
+	}
+	listeners := []*spm.Listener{ln}
+	if cfg.Listen != "" {
+		tlsConfig, err := spm.LoadServerTLS(cfg.Cert, cfg.Key, cfg.ClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tln, err := spm.ListenTLS(cfg.Listen, tlsConfig, cfg.Roles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, tln)
+	}
+	addr := c.String("http")
+	if addr == "" {
+		addr = cfg.HTTP
+	}
+	token := c.String("http-token")
+	if token == "" {
+		token = cfg.HTTPToken
+	}
+	if addr != "" {
+		hln, err := spm.ListenHTTP(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer hln.Close()
+		go func() {
+			if err := http.Serve(hln, spm.NewHTTPHandler(manager, token)); err != nil {
+				log.Println("serve http:", err)
+			}
+		}()
+	}
+	metricsAddr := c.String("metrics")
+	if metricsAddr == "" {
+		metricsAddr = cfg.Metrics
+	}
+	if metricsAddr != "" {
+		mln, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer mln.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", spm.NewMetricsHandler(manager))
+		go func() {
+			if err := http.Serve(mln, mux); err != nil {
+				log.Println("serve metrics:", err)
+			}
+		}()
+	}
 
 	// listen for user termination
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	// start listening for cli apps
-	go func() {
-		if err := sock.Listen(); err != nil {
-			log.Fatal(err)
+	// handle incoming cli app connections
+	for _, ln := range listeners {
+		ln.Metrics = &manager.Requests
+		go serve(ln, manager)
+	}
+	closeListeners := func() {
+		for _, ln := range listeners {
+			if err := ln.Close(); err != nil {
+				log.Println("close sock error: ", err)
+			}
 		}
-	}()
+	}
 
-	// handle incoming cli app connections
-	go func() {
-		for conn := range sock.Connection {
-			go handleMessage(<-conn.Message, conn, manager)
+	if file := c.String("file"); file != "" {
+		tasks, err := spm.LoadTasks(file, nil)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		go manager.StartAll(context.Background(), tasks)
+	}
 
 	log.Println("deamon started")
 	defer func() {
@@ -116,66 +220,299 @@ func startDaemon(c *cli.Context) {
 
 	for {
 		select {
-		case conn := <-sock.Connection:
-			go handleMessage(<-conn.Message, conn, manager)
+		case <-sigchld:
+			manager.ReapOrphans()
+		case code := <-manager.CriticalExit:
+			log.Println("critical task ended, stopping daemon")
+			closeListeners()
+			manager.Shutdown(context.Background(), syscall.SIGTERM)
+			log.Println("deamon ended")
+			os.Exit(code)
 		case killSignal := <-interrupt:
 			stdlog.Println("Got signal:", killSignal)
 			stdlog.Println("Stoping listening")
-			err := sock.Close()
-			if err != nil {
-				log.Println("close sock error: ", err)
-			}
+			closeListeners()
 			if killSignal == os.Interrupt {
 				log.Println("Daemon was interruped by system signal")
 			} else {
 				log.Println("Daemon was killed")
 			}
-			manager.StopAll()
+			manager.Shutdown(context.Background(), killSignal)
 			return
 		}
 	}
 }
 
-func handleMessage(mes spm.Message, conn *spm.Socket, manager *spm.Manager) {
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Println("close conn error: ", err)
+// serve serves the clients of ln until it is closed.
+func serve(ln *spm.Listener, manager *spm.Manager) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
 		}
-	}()
+		go func() {
+			err := ln.Serve(conn, func(req *spm.Request, res *spm.Responder) {
+				handleRequest(req, res, manager)
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
 
-	switch mes.Command {
-	case "start":
-		go manager.StartAll(mes.Jobs)
-	case "list":
-		if err := conn.Send(spm.Message{
-			JobList: manager.List(),
-		}); err != nil {
+func handleRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) {
+	var (
+		result interface{}
+		err    error
+	)
+	switch req.Method {
+	case spm.MethodStart:
+		err = startRequest(req, res, manager)
+	case spm.MethodList:
+		result = spm.ListResult{Tasks: manager.List()}
+	case spm.MethodStop:
+		err = stopRequest(req, res, manager)
+	case spm.MethodRestart:
+		err = restartRequest(req, res, manager)
+	case spm.MethodStatus:
+		result, err = statusRequest(req, manager)
+	case spm.MethodPs:
+		result, err = psRequest(req, manager)
+	case spm.MethodSave, spm.MethodResurrect:
+		err = saveRequest(req, res, manager)
+	case spm.MethodRotate:
+		err = rotateRequest(req, manager)
+	case spm.MethodScale:
+		err = scaleRequest(req, res, manager)
+	case spm.MethodGrep:
+		err = grepRequest(req, res, manager)
+	case spm.MethodLog:
+		result, err = logRequest(req, res, manager)
+	case spm.MethodEvents:
+		err = eventsRequest(req, res, manager)
+	default:
+		err = &spm.Error{Code: spm.CodeUnknownMethod, Message: "unknown method " + req.Method}
+	}
+	if err := res.Finish(result, err); err != nil {
+		select {
+		case <-res.Done():
+			// the client went away
+		default:
 			log.Println(err)
 		}
-	case "stop":
-		if args := mes.Arguments; len(args) > 0 {
-			for _, arg := range args {
-				go manager.Stop(arg)
+	}
+}
+
+// startRequest returns once the tasks have been started.
+func startRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) error {
+	var p spm.StartParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	tasks := p.Jobs
+	if p.Procfile != "" {
+		var err error
+		if tasks, err = spm.LoadTasks(p.Procfile, p.Tasks); err != nil {
+			return err
+		}
+	}
+	return manager.StartAll(res.Context(), tasks)
+}
+
+// stopRequest returns once the tasks have ended.
+func stopRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) error {
+	var p spm.StopParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	if len(p.Tasks) == 0 {
+		return manager.StopAll(res.Context())
+	}
+	errc := make(chan error, len(p.Tasks))
+	for _, task := range p.Tasks {
+		go func(task string) {
+			errc <- manager.Stop(res.Context(), task)
+		}(task)
+	}
+	var first error
+	for range p.Tasks {
+		if err := <-errc; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func restartRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) error {
+	var p spm.RestartParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	for _, task := range p.Tasks {
+		if err := manager.Restart(res.Context(), task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func statusRequest(req *spm.Request, manager *spm.Manager) (interface{}, error) {
+	var p spm.StatusParams
+	if err := req.Decode(&p); err != nil {
+		return nil, err
+	}
+	tasks, err := manager.Status(p.Tasks...)
+	if err != nil {
+		return nil, err
+	}
+	return spm.StatusResult{Tasks: tasks}, nil
+}
+
+func psRequest(req *spm.Request, manager *spm.Manager) (interface{}, error) {
+	var p spm.PsParams
+	if err := req.Decode(&p); err != nil {
+		return nil, err
+	}
+	processes, err := manager.Processes(p.Tasks...)
+	if err != nil {
+		return nil, err
+	}
+	return spm.PsResult{Processes: processes}, nil
+}
+
+func saveRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) error {
+	var p spm.SaveParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	filename := p.File
+	if filename == "" {
+		filename = spm.DefaultDumpFile()
+	}
+	if req.Method == spm.MethodSave {
+		return manager.Save(filename)
+	}
+	return manager.Resurrect(res.Context(), filename)
+}
+
+func rotateRequest(req *spm.Request, manager *spm.Manager) error {
+	var p spm.RotateParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	for _, task := range p.Tasks {
+		if err := manager.Rotate(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scaleRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) error {
+	var p spm.ScaleParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	return manager.Scale(res.Context(), p.Task, p.Count)
+}
+
+// eventsRequest streams the selected events until the client cancels.
+func eventsRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) error {
+	var p spm.EventsParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	for _, typ := range p.Types {
+		if !spm.ValidEventType(typ) {
+			return &spm.Error{Code: spm.CodeBadRequest, Message: "unknown event type " + typ}
+		}
+	}
+	events, unsubscribe := manager.Subscribe(64)
+	defer unsubscribe()
+	for {
+		select {
+		case <-res.Done():
+			return nil
+		case e := <-events:
+			if !p.Match(e) {
+				continue
+			}
+			if err := res.Send(e); err != nil {
+				return err
 			}
-		} else {
-			manager.StopAll()
-		}
-	case "log":
-		job := mes.Arguments[0]
-		if job == "" {
-			_ = conn.Send(spm.Message{
-				JobLogs: []string{"task name cannot be empty"},
-			})
-			return
 		}
-		n, _ := strconv.ParseUint(mes.Arguments[1], 10, 64)
-		if n == 0 {
-			n = 200
+	}
+}
+
+// grepRequest streams the matching lines.
+func grepRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) error {
+	var p spm.GrepParams
+	if err := req.Decode(&p); err != nil {
+		return err
+	}
+	re, err := regexp.Compile(p.Pattern)
+	if err != nil {
+		return &spm.Error{Code: spm.CodeBadRequest, Message: err.Error()}
+	}
+	err = manager.GrepLog(spm.GrepQuery{
+		Task:    p.Task,
+		Pattern: re,
+		Since:   p.Since,
+		Until:   p.Until,
+		Context: p.Context,
+		Stream:  p.Stream,
+	}, func(line spm.LogLine) error {
+		select {
+		case <-res.Done():
+			return errCanceled
+		default:
 		}
-		if err := conn.Send(spm.Message{
-			JobLogs: manager.ReadLog(job, 2),
-		}); err != nil {
-			log.Println(err)
+		return res.Send(spm.LogResult{Lines: []spm.LogLine{line}})
+	})
+	if err == errCanceled {
+		return nil
+	}
+	return err
+}
+
+// errCanceled ends the search of a canceled request.
+var errCanceled = errors.New("canceled")
+
+// logRequest returns the last lines of the logs, or streams them until the
+// request is canceled when they are followed.
+func logRequest(req *spm.Request, res *spm.Responder, manager *spm.Manager) (interface{}, error) {
+	var p spm.LogParams
+	if err := req.Decode(&p); err != nil {
+		return nil, err
+	}
+	tasks := p.Tasks
+	if len(tasks) == 0 {
+		tasks = manager.KnownTasks()
+	}
+	q := spm.LogQuery{
+		Tasks:  tasks,
+		Tail:   p.Tail,
+		Stream: p.Stream,
+		Raw:    p.Raw,
+	}
+	if q.Tail <= 0 {
+		q.Tail = 200
+	}
+	if !p.Follow {
+		lines, err := manager.ReadLogs(q)
+		if err != nil {
+			return nil, err
 		}
+		return spm.LogResult{Tasks: tasks, Lines: lines}, nil
+	}
+
+	// the first response tells the client which tasks it gets lines of
+	if err := res.Send(spm.LogResult{Tasks: tasks}); err != nil {
+		return nil, err
 	}
+	err := manager.FollowLogs(res.Context(), q, func(line spm.LogLine) error {
+		return res.Send(spm.LogResult{Lines: []spm.LogLine{line}})
+	})
+	return nil, err
 }
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/bytegust/spm"
+	"github.com/mattn/go-isatty"
 	"github.com/urfave/cli"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
 var procfile string
@@ -18,14 +28,62 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "spm - Simple Process Manager"
 	app.Usage = "spm [OPTIONS] COMMAND [args...]"
-	app.Version = "0.0.1"
+	app.Version = spm.Version
 	app.Author = "duanquanyong@outlook.com"
+	app.Flags = remoteFlags
 
 	app.Commands = cli.Commands{
 		{
 			Name:   "daemon",
 			Usage:  "run spm daemon service",
 			Action: startDaemon,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "procfile whose tasks are started with the daemon",
+				},
+				cli.BoolFlag{
+					Name:  "init",
+					Usage: "run as container entrypoint: reap zombies, mirror task output to stdout, exit with critical tasks",
+				},
+				cli.StringFlag{
+					Name:  "log-dir",
+					Value: spm.DefaultLogDir(),
+					Usage: "directory of the task log files",
+				},
+				cli.StringFlag{
+					Name:  "log-format",
+					Value: spm.LogFormatRFC3339Nano,
+					Usage: "time format of log lines: rfc3339nano, epoch or none",
+				},
+				cli.StringFlag{
+					Name:  "log-output",
+					Value: spm.LogOutputText,
+					Usage: "encoding of log lines: text or json",
+				},
+				cli.DurationFlag{
+					Name:  "stop-timeout",
+					Usage: "time a task gets to stop before it is killed, 0 waits forever",
+				},
+				cli.StringFlag{
+					Name:  "config",
+					Value: spm.DefaultConfigFile(),
+					Usage: "daemon configuration, e.g. for remote clients",
+				},
+				cli.StringFlag{
+					Name:  "http",
+					Usage: "serve the REST API and dashboard on `ADDR`, unix:/path or a localhost TCP address",
+				},
+				cli.StringFlag{
+					Name:   "http-token",
+					EnvVar: "SPM_HTTP_TOKEN",
+					Usage:  "bearer token that allows changing tasks over HTTP, read-only without one",
+				},
+				cli.StringFlag{
+					Name:  "metrics",
+					Usage: "serve Prometheus metrics at /metrics on the TCP address `ADDR`",
+				},
+			},
 			Subcommands: cli.Commands{
 				{
 					Name:   "install",
@@ -67,14 +125,87 @@ func main() {
 			Usage:  " Stop tasks if currently running",
 			Action: stopAction,
 		},
+		{
+			Name:      "restart",
+			Usage:     "Restarts tasks, reloaded from their Procfile",
+			UsageText: "spm restart task...",
+			Action:    restartAction,
+		},
+		{
+			Name:      "scale",
+			Usage:     "Runs a number of instances of a started task",
+			UsageText: "spm scale task count",
+			Action:    scaleAction,
+		},
 		{
 			Name:   "list",
 			Usage:  "Lists all running tasks",
 			Action: listAction,
 		},
+		{
+			Name:      "status",
+			Usage:     "Shows state, pid, uptime and restarts of tasks",
+			UsageText: "spm status [task...]",
+			Action:    statusAction,
+		},
+		{
+			Name:      "events",
+			Usage:     "Prints the events of tasks as JSON lines as they happen",
+			UsageText: "spm events [--type type,...] [task...]",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "type, t",
+					Usage: "only events of `TYPE`: " + strings.Join(spm.EventTypes, ", "),
+				},
+			},
+			Action: eventsAction,
+		},
+		{
+			Name:      "ps",
+			Usage:     "Shows the process trees of running tasks with their resource usage",
+			UsageText: "spm ps [--sort column] [task...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "sort, s",
+					Usage: "sort by `COLUMN` instead of showing trees: task, pid, pgid, user, state, uptime, cpu, rss, threads, fds, children or command",
+				},
+			},
+			Action: psAction,
+		},
+		{
+			Name:      "top",
+			Usage:     "Shows the processes of running tasks, refreshed live",
+			UsageText: "spm top [--sort column] [--interval duration] [task...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "sort, s",
+					Value: "cpu",
+					Usage: "sort by `COLUMN`, see spm ps",
+				},
+				cli.DurationFlag{
+					Name:  "interval, n",
+					Value: 2 * time.Second,
+					Usage: "time between refreshes",
+				},
+			},
+			Action: topAction,
+		},
+		{
+			Name:      "save",
+			Usage:     "Saves the running tasks so they can be resurrected later",
+			UsageText: "spm save [file]",
+			Action:    saveAction,
+		},
+		{
+			Name:      "resurrect",
+			Usage:     "Starts the tasks saved by spm save",
+			UsageText: "spm resurrect [file]",
+			Action:    saveAction,
+		},
 		{
 			Name:      "log",
-			Usage:     "Prints last n lines of task's logfile",
+			Aliases:   []string{"logs"},
+			Usage:     "Prints last n lines of the logfiles of tasks interleaved, or follows them",
 			UsageText: "spm log [task...]",
 			Flags: []cli.Flag{
 				cli.Uint64Flag{
@@ -82,8 +213,56 @@ func main() {
 					Value: 200,
 					Usage: "the line number",
 				},
+				cli.BoolFlag{
+					Name:  "stderr",
+					Usage: "only show error output",
+				},
+				cli.BoolFlag{
+					Name:  "raw",
+					Usage: "print lines as they are stored in the logfile",
+				},
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "show the logs of all tasks",
+				},
+				cli.BoolFlag{
+					Name:  "follow, f",
+					Usage: "keep printing lines as they are written",
+				},
 			},
 			Action: logsAction,
+			Subcommands: cli.Commands{
+				{
+					Name:      "grep",
+					Usage:     "Searches the logfiles of a task, rotated ones included",
+					UsageText: "spm log grep [--since time] [--until time] [-C n] task regexp",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "since",
+							Usage: "only lines written at or after time, e.g. 2019-04-18T02:00:00Z, 02:00 or 15m (ago)",
+						},
+						cli.StringFlag{
+							Name:  "until",
+							Usage: "only lines written at or before time",
+						},
+						cli.IntFlag{
+							Name:  "context, C",
+							Usage: "print n lines around every match",
+						},
+						cli.BoolFlag{
+							Name:  "stderr",
+							Usage: "only search error output",
+						},
+					},
+					Action: logGrepAction,
+				},
+				{
+					Name:      "rotate",
+					Usage:     "Rotates the logfiles of tasks",
+					UsageText: "spm log rotate [task...]",
+					Action:    logRotateAction,
+				},
+			},
 		},
 	}
 
@@ -93,112 +272,453 @@ func main() {
 }
 
 func startAction(c *cli.Context) {
-	procfile := getProcfilePath(procfile)
-	file, err := os.Open(procfile)
+	procfile, err := filepath.Abs(getProcfilePath(procfile))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	p := spm.NewParser(file)
-	jobs, err := p.Parse()
+	ts := targets(c)
+	var jobs []spm.Task
+	if ts[0].host != "" {
+		// remote daemons can't read our Procfile, they get its tasks
+		if jobs, err = spm.LoadTasks(procfile, c.Args()); err != nil {
+			log.Fatal(err)
+		}
+		for i := range jobs {
+			jobs[i].Procfile = ""
+		}
+	}
+	err = each(ts, func(t target) error {
+		if t.host != "" {
+			return t.StartJobs(context.Background(), jobs)
+		}
+		// the daemon parses the Procfile itself, we only tell it where it is
+		return t.Start(context.Background(), procfile, c.Args()...)
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Println("done")
+}
 
-	sock := spm.NewSocket()
-	if err := sock.Dial(); err != nil {
+func stopAction(c *cli.Context) {
+	err := each(targets(c), func(t target) error {
+		return t.Stop(context.Background(), c.Args()...)
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
+	log.Println("done")
+}
 
-	var j []spm.Task
-	if args := c.Args(); len(args) > 0 {
-		for _, arg := range args {
-			exist := false
-			for _, job := range jobs {
-				if job.Name == arg {
-					j = append(j, job)
-					exist = true
-					break
-				}
-			}
-			if !exist {
-				fmt.Printf("job %s is not exist in procfile\n", arg)
-			}
-		}
-	} else {
-		j = jobs
+func restartAction(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return cli.ShowCommandHelp(c, c.Command.Name)
 	}
-
-	if err := sock.Send(spm.Message{
-		Command: "start",
-		Jobs:    j,
-	}); err != nil {
+	err := each(targets(c), func(t target) error {
+		return t.Restart(context.Background(), c.Args()...)
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	<-sock.Message
 	log.Println("done")
+	return nil
 }
 
-func stopAction(c *cli.Context) {
-	sock := spm.NewSocket()
-	if err := sock.Dial(); err != nil {
-		log.Fatal(err)
+func scaleAction(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return cli.ShowCommandHelp(c, c.Command.Name)
 	}
-
-	if err := sock.Send(spm.Message{
-		Command:   "stop",
-		Arguments: c.Args(),
-	}); err != nil {
+	count, err := strconv.Atoi(c.Args().Get(1))
+	if err != nil {
+		log.Fatalf("bad count %s", c.Args().Get(1))
+	}
+	err = each(targets(c), func(t target) error {
+		return t.Scale(context.Background(), c.Args().First(), count)
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	<-sock.Message
 	log.Println("done")
+	return nil
 }
 
-func listAction(c *cli.Context) {
-	sock := spm.NewSocket()
-	if err := sock.Dial(); err != nil {
-		log.Fatal(err)
+// saveAction serves both save and resurrect, which only differ in command.
+func saveAction(c *cli.Context) {
+	file := c.Args().First()
+	// a path for remote daemons is on their hosts, relative to their directory
+	if file != "" && c.GlobalString("host") == "" {
+		var err error
+		if file, err = filepath.Abs(file); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	if err := sock.Send(spm.Message{
-		Command: "list",
-	}); err != nil {
+	err := each(targets(c), func(t target) error {
+		if c.Command.Name == "save" {
+			return t.Save(context.Background(), file)
+		}
+		return t.Resurrect(context.Background(), file)
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
+	log.Println("done")
+}
 
-	m := <-sock.Message
+// listTasks returns the sorted tasks of all targets, prefixed with their
+// hosts when there are several. The tasks of the targets that answered are
+// returned along with the errors of the others.
+func listTasks(ts []target) ([]string, error) {
+	var (
+		mu    sync.Mutex
+		tasks []string
+	)
+	err := each(ts, func(t target) error {
+		list, err := t.List(context.Background())
+		mu.Lock()
+		defer mu.Unlock()
+		for _, task := range list {
+			tasks = append(tasks, t.name(task, len(ts) > 1))
+		}
+		return err
+	})
+	sort.Strings(tasks)
+	return tasks, err
+}
+
+func listAction(c *cli.Context) {
+	ts := targets(c)
+	tasks, err := listTasks(ts)
+	// with several daemons the ones that answered are shown anyway
+	if err != nil && len(ts) == 1 {
+		log.Fatal(err)
+	}
 	fmt.Println("Running jobs:")
-	for _, job := range m.JobList {
+	for _, job := range tasks {
 		fmt.Printf("\t%s\n", job)
 	}
 	fmt.Println("") // line break
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// taskStatus is a row of spm status.
+type taskStatus struct {
+	host string
+	spm.TaskStatus
+}
+
+// statuses returns the status of tasks of all targets in the order of the
+// targets. Like processes, it returns the rows of the targets that answered
+// along with the errors of the others.
+func statuses(ts []target, tasks []string) ([]taskStatus, error) {
+	var mu sync.Mutex
+	results := make(map[string][]spm.TaskStatus)
+	err := each(ts, func(t target) error {
+		list, err := t.Status(context.Background(), tasks...)
+		mu.Lock()
+		results[t.host] = list
+		mu.Unlock()
+		return err
+	})
+	var sts []taskStatus
+	for _, t := range ts {
+		for _, s := range results[t.host] {
+			sts = append(sts, taskStatus{host: t.host, TaskStatus: s})
+		}
+	}
+	return sts, err
+}
+
+// printStatus prints sts as a table.
+func printStatus(out io.Writer, sts []taskStatus, several bool) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tPID\tUPTIME\tRESTARTS\tCOMMAND")
+	for _, t := range sts {
+		pid, uptime := "-", "-"
+		if t.Pid != 0 {
+			pid = strconv.Itoa(t.Pid)
+		}
+		if !t.Started.IsZero() {
+			uptime = time.Since(t.Started).Round(time.Second).String()
+		}
+		state := t.State
+		if t.Error != "" {
+			state += " (" + t.Error + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", target{host: t.host}.name(t.Name, several), state, pid, uptime, t.Restarts, strings.Join(t.Command, " "))
+	}
+	w.Flush()
+}
+
+func statusAction(c *cli.Context) {
+	ts := targets(c)
+	sts, err := statuses(ts, c.Args())
+	if err != nil && len(ts) == 1 {
+		log.Fatal(err)
+	}
+	printStatus(os.Stdout, sts, len(ts) > 1)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func logsAction(c *cli.Context) error {
-	if job := c.Args().First(); job == "" {
+	if len(c.Args()) == 0 && !c.Bool("all") {
 		return cli.ShowCommandHelp(c, c.Command.Name)
 	}
 
-	sock := spm.NewSocket()
-	if err := sock.Dial(); err != nil {
+	var stream string
+	if c.Bool("stderr") {
+		stream = spm.Stderr
+	}
+	// no tasks means all of them
+	var tasks []string
+	if !c.Bool("all") {
+		tasks = c.Args()
+	}
+	params := spm.LogParams{
+		Tasks:  tasks,
+		Tail:   int(c.Uint64("n")),
+		Stream: stream,
+		Raw:    c.Bool("raw"),
+	}
+
+	ts := targets(c)
+	several := len(ts) > 1
+	p := logPrinter{tty: isatty.IsTerminal(os.Stdout.Fd())}
+	var mu sync.Mutex
+	printLine := func(line spm.LogLine) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if c.Bool("raw") {
+			fmt.Println(line.Raw)
+		} else {
+			p.print(line)
+		}
+		return nil
+	}
+	for _, t := range ts {
+		for _, task := range tasks {
+			p.fit(t.name(task, several))
+		}
+	}
+
+	// a followed log keeps streaming until interrupted
+	if c.Bool("follow") {
+		err := each(ts, func(t target) error {
+			return t.Subscribe(context.Background(), params, func(line spm.LogLine) error {
+				line.Task = t.name(line.Task, several)
+				return printLine(line)
+			})
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return nil
+	}
+	var lines []spm.LogLine
+	err := each(ts, func(t target) error {
+		got, err := t.Logs(context.Background(), params)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range got {
+			line.Task = t.name(line.Task, several)
+			lines = append(lines, line)
+		}
+		return err
+	})
+	if err != nil && len(ts) == 1 {
 		log.Fatal(err)
 	}
+	// the lines of each daemon are in time order already
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time.Before(lines[j].Time) })
+	for _, line := range lines {
+		p.fit(line.Task)
+	}
+	for _, line := range lines {
+		printLine(line)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+// logPrinter prints log lines of several tasks foreman style, with aligned
+// task names in their own colors.
+type logPrinter struct {
+	tty   bool
+	width int
+}
 
-	if err := sock.Send(spm.Message{
-		Command:   "log",
-		Arguments: []string{c.Args().Get(0), strconv.FormatUint(c.Uint64("n"), 10)},
-	}); err != nil {
+// fit widens the task column for task.
+func (p *logPrinter) fit(task string) {
+	if len(task) > p.width {
+		p.width = len(task)
+	}
+}
+
+func (p *logPrinter) print(line spm.LogLine) {
+	p.fit(line.Task)
+	sep := "|"
+	// grep style, context lines of a search are set apart from matches
+	if line.Context {
+		sep = "-"
+	}
+	prefix := fmt.Sprintf("%-*s %s ", p.width, line.Task, sep)
+	if !line.Time.IsZero() {
+		prefix = line.Time.Format("15:04:05") + " " + prefix
+	}
+	if !p.tty {
+		fmt.Println(prefix + line.Text)
+		return
+	}
+	text := line.Text
+	// highlight error output
+	if line.Stream == spm.Stderr {
+		text = "\033[31m" + text + "\033[0m"
+	}
+	fmt.Printf("\033[38;5;%dm%s\033[0m%s\n", spm.TaskColor(line.Task), prefix, text)
+}
+
+func eventsAction(c *cli.Context) {
+	p := spm.EventsParams{Tasks: c.Args()}
+	for _, types := range c.StringSlice("type") {
+		for _, typ := range strings.Split(types, ",") {
+			if typ = strings.TrimSpace(typ); typ != "" {
+				p.Types = append(p.Types, typ)
+			}
+		}
+	}
+
+	ts := targets(c)
+	enc := json.NewEncoder(os.Stdout)
+	var mu sync.Mutex
+	follow := func(t target) error {
+		return t.Events(context.Background(), p, func(e spm.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			// the host tells the events of several daemons apart
+			return enc.Encode(struct {
+				Host string `json:",omitempty"`
+				spm.Event
+			}{t.host, e})
+		})
+	}
+	if len(ts) == 1 {
+		if err := follow(ts[0]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// events never end on their own, so the error of a daemon is printed
+	// when it happens instead of once all of them are gone
+	var (
+		wg     sync.WaitGroup
+		failed bool
+	)
+	for _, t := range ts {
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			if err := follow(t); err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+				log.Printf("%s: %s", t.host, err)
+			}
+		}(t)
+	}
+	wg.Wait()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func logGrepAction(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return cli.ShowCommandHelp(c, c.Command.Name)
+	}
+	now := time.Now()
+	since, err := parseTime(c.String("since"), now)
+	if err != nil {
+		return err
+	}
+	until, err := parseTime(c.String("until"), now)
+	if err != nil {
+		return err
+	}
+	var stream string
+	if c.Bool("stderr") {
+		stream = spm.Stderr
+	}
+
+	ts := targets(c)
+	p := logPrinter{tty: isatty.IsTerminal(os.Stdout.Fd())}
+	for _, t := range ts {
+		p.fit(t.name(c.Args().Get(0), len(ts) > 1))
+	}
+	var mu sync.Mutex
+	err = each(ts, func(t target) error {
+		return t.Grep(context.Background(), spm.GrepParams{
+			Task:    c.Args().Get(0),
+			Pattern: c.Args().Get(1),
+			Since:   since,
+			Until:   until,
+			Context: c.Int("context"),
+			Stream:  stream,
+		}, func(line spm.LogLine) error {
+			line.Task = t.name(line.Task, len(ts) > 1)
+			mu.Lock()
+			p.print(line)
+			mu.Unlock()
+			return nil
+		})
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
+	return nil
+}
 
-	m := <-sock.Message
-	for i := range m.JobLogs {
-		fmt.Println(m.JobLogs[i])
+// parseTime parses the time of a --since or --until flag. It is either a
+// point in time, a time of today or a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
 	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			y, m, d := now.Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can not parse time %s", s)
+}
 
+func logRotateAction(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return cli.ShowCommandHelp(c, c.Command.Name)
+	}
+
+	err := each(targets(c), func(t target) error {
+		return t.Rotate(context.Background(), c.Args()...)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	return nil
 }
 
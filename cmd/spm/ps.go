@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bytegust/spm"
+	"github.com/mattn/go-isatty"
+	"github.com/urfave/cli"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// process is a row of spm ps and spm top.
+type process struct {
+	host string
+	spm.ProcessInfo
+}
+
+// psColumns are the columns of spm ps and spm top by their --sort names,
+// less orders two rows by the column.
+var psColumns = []struct {
+	name, title string
+	less        func(a, b process) bool
+}{
+	{"task", "TASK", func(a, b process) bool { return a.host+"/"+a.Task < b.host+"/"+b.Task }},
+	{"pid", "PID", func(a, b process) bool { return a.Pid < b.Pid }},
+	{"pgid", "PGID", func(a, b process) bool { return a.Pgid < b.Pgid }},
+	{"user", "USER", func(a, b process) bool { return a.User < b.User }},
+	{"state", "STATE", func(a, b process) bool { return a.State < b.State }},
+	// usage sorts from the top
+	{"uptime", "UPTIME", func(a, b process) bool { return a.Started.Before(b.Started) }},
+	{"cpu", "CPU%", func(a, b process) bool { return a.CPU > b.CPU }},
+	{"rss", "RSS", func(a, b process) bool { return a.RSS > b.RSS }},
+	{"threads", "THR", func(a, b process) bool { return a.Threads > b.Threads }},
+	{"fds", "FDS", func(a, b process) bool { return a.FDs > b.FDs }},
+	{"children", "CHILD", func(a, b process) bool { return a.Children > b.Children }},
+	{"command", "COMMAND", func(a, b process) bool {
+		return strings.Join(a.Command, " ") < strings.Join(b.Command, " ")
+	}},
+}
+
+// sortProcesses sorts ps by column, it keeps the process trees for an
+// empty column.
+func sortProcesses(ps []process, column string) error {
+	if column == "" {
+		return nil
+	}
+	for _, col := range psColumns {
+		if col.name == strings.ToLower(column) {
+			sort.SliceStable(ps, func(i, j int) bool { return col.less(ps[i], ps[j]) })
+			return nil
+		}
+	}
+	var names []string
+	for _, col := range psColumns {
+		names = append(names, col.name)
+	}
+	return fmt.Errorf("unknown column %s, one of %s", column, strings.Join(names, ", "))
+}
+
+// processes returns the processes of tasks of all targets. The processes of
+// the targets that answered are returned along with the errors of the
+// others.
+func processes(ts []target, tasks []string) ([]process, error) {
+	var mu sync.Mutex
+	results := make(map[string][]spm.ProcessInfo)
+	err := each(ts, func(t target) error {
+		infos, err := t.Processes(context.Background(), tasks...)
+		mu.Lock()
+		results[t.host] = infos
+		mu.Unlock()
+		return err
+	})
+	var ps []process
+	for _, t := range ts {
+		for _, info := range results[t.host] {
+			ps = append(ps, process{host: t.host, ProcessInfo: info})
+		}
+	}
+	return ps, err
+}
+
+// printProcesses prints ps as a table, the commands of trees indented.
+func printProcesses(out io.Writer, ps []process, several, tree bool) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	var titles []string
+	for _, col := range psColumns {
+		titles = append(titles, col.title)
+	}
+	fmt.Fprintln(w, strings.Join(titles, "\t"))
+	for _, p := range ps {
+		command := strings.Join(p.Command, " ")
+		if tree && p.Depth > 0 {
+			command = strings.Repeat("  ", p.Depth-1) + "\\_ " + command
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%.1f\t%s\t%d\t%d\t%d\t%s\n",
+			target{host: p.host}.name(p.Task, several), p.Pid, p.Pgid, p.User, p.State,
+			time.Since(p.Started).Round(time.Second), p.CPU, formatBytes(p.RSS),
+			p.Threads, p.FDs, p.Children, command)
+	}
+	w.Flush()
+}
+
+// formatBytes formats n with a binary unit like ps does.
+func formatBytes(n uint64) string {
+	const units = "KMGTP"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
+
+func psAction(c *cli.Context) {
+	ts := targets(c)
+	ps, err := processes(ts, c.Args())
+	if err != nil && len(ts) == 1 {
+		log.Fatal(err)
+	}
+	if err := sortProcesses(ps, c.String("sort")); err != nil {
+		log.Fatal(err)
+	}
+	printProcesses(os.Stdout, ps, len(ts) > 1, c.String("sort") == "")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// sampleKey identifies a process across refreshes of spm top.
+type sampleKey struct {
+	host    string
+	pid     int
+	started time.Time
+}
+
+// topAction prints the processes every interval, their CPU usage measured
+// since the previous refresh. On a terminal < and > sort by the previous or
+// next column and q quits.
+func topAction(c *cli.Context) {
+	ts := targets(c)
+	column := c.String("sort")
+	if column == "" {
+		column = "cpu"
+	}
+	if err := sortProcesses(nil, column); err != nil {
+		log.Fatal(err)
+	}
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+
+	keys := make(chan byte)
+	hint := ""
+	if isatty.IsTerminal(os.Stdin.Fd()) {
+		if restore, err := rawTerminal(int(os.Stdin.Fd())); err == nil {
+			defer restore()
+			// ^C ends spm top through the signal, the terminal is restored
+			// before
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-interrupt
+				restore()
+				os.Exit(1)
+			}()
+			go readKeys(os.Stdin, keys)
+			hint = " (< > sort, q quits)"
+		}
+	}
+
+	prev := make(map[sampleKey]time.Duration)
+	var prevTime time.Time
+	for {
+		ps, err := processes(ts, c.Args())
+		now := time.Now()
+		samples := make(map[sampleKey]time.Duration, len(ps))
+		for i := range ps {
+			key := sampleKey{ps[i].host, ps[i].Pid, ps[i].Started}
+			samples[key] = ps[i].CPUTime
+			if cpu, ok := prev[key]; ok && now.After(prevTime) {
+				ps[i].CPU = float64(ps[i].CPUTime-cpu) / float64(now.Sub(prevTime)) * 100
+			}
+		}
+		prev, prevTime = samples, now
+
+		refresh := time.After(interval)
+	draw:
+		for {
+			_ = sortProcesses(ps, column)
+			// home the cursor and clear the screen
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("spm top - %s, %d processes, sorted by %s%s\n\n", now.Format("15:04:05"), len(ps), column, hint)
+			printProcesses(os.Stdout, ps, len(ts) > 1, false)
+			if err != nil {
+				fmt.Println()
+				fmt.Println(err)
+			}
+
+			select {
+			case <-refresh:
+				break draw
+			case key := <-keys:
+				switch key {
+				case 'q':
+					return
+				case '<':
+					column = nextColumn(column, -1)
+				case '>':
+					column = nextColumn(column, 1)
+				}
+			}
+		}
+	}
+}
+
+// readKeys sends the bytes read from r to keys until it fails.
+func readKeys(r io.Reader, keys chan<- byte) {
+	b := make([]byte, 1)
+	for {
+		if _, err := r.Read(b); err != nil {
+			return
+		}
+		keys <- b[0]
+	}
+}
+
+// nextColumn returns the column step columns after column in psColumns,
+// wrapping around at both ends.
+func nextColumn(column string, step int) string {
+	for i, col := range psColumns {
+		if col.name == column {
+			n := len(psColumns)
+			return psColumns[((i+step)%n+n)%n].name
+		}
+	}
+	return column
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bytegust/spm"
+	"github.com/bytegust/spm/client"
+	"github.com/urfave/cli"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// defaultPort is the port of remote daemons given without one.
+const defaultPort = "7777"
+
+var remoteFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "host, H",
+		EnvVar: "SPM_HOST",
+		Usage:  "talk to the daemons on `HOST[:PORT],...` over TLS instead of the local one",
+	},
+	cli.StringFlag{
+		Name:   "cert",
+		EnvVar: "SPM_CERT",
+		Value:  filepath.Join(spm.Dir(), "client.crt"),
+		Usage:  "client certificate for remote daemons",
+	},
+	cli.StringFlag{
+		Name:   "key",
+		EnvVar: "SPM_KEY",
+		Value:  filepath.Join(spm.Dir(), "client.key"),
+		Usage:  "key of the client certificate",
+	},
+	cli.StringFlag{
+		Name:   "ca",
+		EnvVar: "SPM_CA",
+		Value:  filepath.Join(spm.Dir(), "ca.crt"),
+		Usage:  "CA that signed the certificates of remote daemons",
+	},
+}
+
+// target is a daemon the cli talks to, host is empty for the local one.
+type target struct {
+	host string
+	*client.Client
+}
+
+// name prefixes task with the host of t when there are several targets.
+func (t target) name(task string, several bool) string {
+	if !several {
+		return task
+	}
+	return t.host + "/" + task
+}
+
+// targets returns the daemons selected by --host, the local one without it.
+func targets(c *cli.Context) []target {
+	hosts := c.GlobalString("host")
+	if hosts == "" {
+		return []target{{Client: client.New()}}
+	}
+	var addrs []string
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, defaultPort)
+		}
+		addrs = append(addrs, host)
+	}
+	if len(addrs) == 0 {
+		log.Fatalf("no host in --host %q", hosts)
+	}
+	cfg, err := spm.LoadClientTLS(c.GlobalString("cert"), c.GlobalString("key"), c.GlobalString("ca"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts := make([]target, 0, len(addrs))
+	for _, host := range addrs {
+		ts = append(ts, target{host: host, Client: client.NewRemote(host, cfg)})
+	}
+	return ts
+}
+
+// each runs fn against all targets at once. The error of a single target is
+// returned as is, those of several are prefixed with their hosts.
+func each(ts []target, fn func(t target) error) error {
+	if len(ts) == 1 {
+		return fn(ts[0])
+	}
+	errs := make([]error, len(ts))
+	var wg sync.WaitGroup
+	for i, t := range ts {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			errs[i] = fn(t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", ts[i].host, err))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
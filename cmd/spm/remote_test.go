@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/bytegust/spm"
+	"github.com/bytegust/spm/client"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeDaemon serves list and status with a single task web on a temporary
+// socket.
+func fakeDaemon(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "spm-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := spm.SocketPath
+	spm.SocketPath = filepath.Join(dir, "spm.sock")
+	ln, err := spm.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := func(req *spm.Request, res *spm.Responder) {
+		switch req.Method {
+		case spm.MethodList:
+			res.Finish(spm.ListResult{Tasks: []string{"web"}}, nil)
+		case spm.MethodStatus:
+			res.Finish(spm.StatusResult{Tasks: []spm.TaskStatus{{Name: "web", State: spm.StateRunning, Pid: 42}}}, nil)
+		}
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ln.Serve(c, handle)
+		}
+	}()
+	return func() {
+		ln.Close()
+		spm.SocketPath = old
+		os.RemoveAll(dir)
+	}
+}
+
+// testTargets returns a target that answers and one nothing listens on.
+func testTargets() []target {
+	return []target{
+		{host: "good:7777", Client: client.New()},
+		{host: "bad:7777", Client: client.NewRemote("127.0.0.1:1", &tls.Config{})},
+	}
+}
+
+func TestListTasks(t *testing.T) {
+	defer fakeDaemon(t)()
+	ts := testTargets()
+
+	tasks, err := listTasks(ts)
+	if want := []string{"good:7777/web"}; !reflect.DeepEqual(tasks, want) {
+		t.Errorf("got tasks %v, want %v", tasks, want)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "bad:7777: ") || strings.Contains(err.Error(), "good:7777") {
+		t.Errorf("got error %v, want one of bad:7777 only", err)
+	}
+
+	// the error of a single target is not prefixed
+	_, err = listTasks(ts[1:])
+	if err == nil || strings.HasPrefix(err.Error(), "bad:7777") {
+		t.Errorf("got error %v from a single target", err)
+	}
+	if tasks, err := listTasks(ts[:1]); err != nil || !reflect.DeepEqual(tasks, []string{"web"}) {
+		t.Errorf("got tasks %v, %v from a single target", tasks, err)
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	defer fakeDaemon(t)()
+	ts := testTargets()
+
+	sts, err := statuses(ts, nil)
+	if len(sts) != 1 || sts[0].host != "good:7777" || sts[0].Pid != 42 {
+		t.Errorf("got status %+v", sts)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "bad:7777: ") {
+		t.Errorf("got error %v, want one of bad:7777", err)
+	}
+
+	var out bytes.Buffer
+	printStatus(&out, sts, true)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "good:7777/web ") || !strings.Contains(lines[1], " 42 ") {
+		t.Errorf("got table\n%s", out.String())
+	}
+}
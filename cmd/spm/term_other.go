@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// rawTerminal is only supported on linux, spm top has no key bindings
+// elsewhere.
+func rawTerminal(fd int) (restore func(), err error) {
+	return nil, errors.New("raw terminal is not supported on this platform")
+}
@@ -0,0 +1,73 @@
+package spm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultConfigFile is the configuration file of the daemon.
+func DefaultConfigFile() string {
+	return filepath.Join(Dir(), "daemon.json")
+}
+
+// Config is the configuration of the daemon.
+type Config struct {
+	// Listen is a TCP address remote clients connect to with mutual TLS,
+	// empty serves the unix socket only.
+	Listen string `json:",omitempty"`
+	// Cert and Key are the certificate of the daemon, ClientCA are the CAs
+	// that sign the certificates of clients.
+	Cert     string `json:",omitempty"`
+	Key      string `json:",omitempty"`
+	ClientCA string `json:",omitempty"`
+	// Roles maps the common names of client certificates to their roles,
+	// "*" matches every name.
+	Roles map[string]string `json:",omitempty"`
+
+	// HTTP is the address of the REST API and the dashboard, see ListenHTTP.
+	HTTP string `json:",omitempty"`
+	// HTTPToken is the bearer token that allows changing tasks over HTTP.
+	HTTPToken string `json:",omitempty"`
+	// Metrics is a TCP address that serves Prometheus metrics at /metrics,
+	// which are also part of the REST API.
+	Metrics string `json:",omitempty"`
+}
+
+// ReadConfig reads the configuration in filename. A missing file results in
+// an empty configuration.
+func ReadConfig(filename string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %s", filename, err)
+	}
+	return cfg, cfg.Valid()
+}
+
+// Valid returns an error if the configuration is incomplete.
+func (cfg Config) Valid() error {
+	if cfg.Listen == "" {
+		return nil
+	}
+	if cfg.Cert == "" || cfg.Key == "" || cfg.ClientCA == "" {
+		return fmt.Errorf("listening on %s needs Cert, Key and ClientCA", cfg.Listen)
+	}
+	if len(cfg.Roles) == 0 {
+		return fmt.Errorf("listening on %s needs Roles of clients", cfg.Listen)
+	}
+	for name, role := range cfg.Roles {
+		if !ValidRole(role) {
+			return fmt.Errorf("unknown role %s of %s", role, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package spm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigValid(t *testing.T) {
+	base := Config{Listen: ":7777", Cert: "server.crt", Key: "server.key", ClientCA: "ca.crt"}
+	for _, test := range []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{"unix socket only", Config{}, true},
+		{"no roles", base, false},
+		{"no certificate", Config{Listen: ":7777", Roles: map[string]string{"*": RoleViewer}}, false},
+		{"unknown role", Config{Listen: base.Listen, Cert: base.Cert, Key: base.Key, ClientCA: base.ClientCA,
+			Roles: map[string]string{"ops": "root"}}, false},
+		{"complete", Config{Listen: base.Listen, Cert: base.Cert, Key: base.Key, ClientCA: base.ClientCA,
+			Roles: map[string]string{"ops": RoleAdmin, "*": RoleViewer}}, true},
+	} {
+		if err := test.cfg.Valid(); (err == nil) != test.valid {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "daemon.json")
+
+	if cfg, err := ReadConfig(filename); err != nil || cfg.Listen != "" {
+		t.Errorf("got config %+v, %v from a missing file", cfg, err)
+	}
+	// a daemon listening without roles would refuse every client
+	err = ioutil.WriteFile(filename, []byte(`{"Listen":":7777","Cert":"server.crt","Key":"server.key","ClientCA":"ca.crt"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(filename); err == nil {
+		t.Error("config listening without roles accepted")
+	}
+}
@@ -0,0 +1,280 @@
+package spm
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// dashboardFiles are the static files of the dashboard, compiled into the
+// binary so that it works without network access. It talks to the REST API
+// only.
+var dashboardFiles = map[string]struct {
+	contentType string
+	content     string
+}{
+	"/":              {"text/html; charset=utf-8", dashboardHTML},
+	"/dashboard.css": {"text/css; charset=utf-8", dashboardCSS},
+	"/dashboard.js":  {"application/javascript; charset=utf-8", dashboardJS},
+}
+
+// serveDashboard serves the files of the dashboard, other paths are unknown.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	f, ok := dashboardFiles[r.URL.Path]
+	if !ok {
+		writeHTTPError(w, &Error{Code: CodeUnknownMethod, Message: "unknown path " + r.URL.Path})
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	fmt.Fprint(w, f.content)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>spm</title>
+<link rel="stylesheet" href="/dashboard.css">
+</head>
+<body>
+<header>
+  <h1>spm</h1>
+  <span id="mode" class="mode">read-only</span>
+  <form id="auth">
+    <input id="token" type="password" placeholder="token" autocomplete="current-password">
+    <button type="submit">Sign in</button>
+  </form>
+</header>
+<main>
+  <p id="error" class="error" hidden></p>
+  <table>
+    <thead>
+      <tr><th>Task</th><th>State</th><th>PID</th><th>Uptime</th><th>Restarts</th><th>CPU</th><th>Memory</th><th></th></tr>
+    </thead>
+    <tbody id="tasks"></tbody>
+  </table>
+  <section id="logs" hidden>
+    <h2><span id="logs-task"></span> <button id="logs-close" type="button">Close</button></h2>
+    <pre id="logs-lines"></pre>
+  </section>
+</main>
+<script src="/dashboard.js"></script>
+</body>
+</html>
+`
+
+const dashboardCSS = `body {
+  margin: 0;
+  font: 14px/1.4 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif;
+  color: #222;
+  background: #fafafa;
+}
+header {
+  display: flex;
+  align-items: center;
+  gap: 1em;
+  padding: 0.5em 1em;
+  background: #263238;
+  color: #fff;
+}
+header h1 { margin: 0; font-size: 1.2em; }
+header form { margin-left: auto; }
+main { padding: 1em; }
+.mode { font-size: 0.85em; opacity: 0.8; }
+.error { color: #b71c1c; }
+table { width: 100%; border-collapse: collapse; background: #fff; }
+th, td { padding: 0.4em 0.6em; text-align: left; border-bottom: 1px solid #e0e0e0; }
+th { font-weight: 600; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+td a { color: inherit; cursor: pointer; text-decoration: underline; }
+button { margin-right: 0.3em; }
+.running { color: #2e7d32; }
+.starting, .stopping, .backoff { color: #ef6c00; }
+.failed { color: #b71c1c; }
+.stopped, .exited { color: #757575; }
+#logs h2 { font-size: 1em; margin: 1.5em 0 0.5em; }
+#logs-lines {
+  height: 50vh;
+  overflow: auto;
+  margin: 0;
+  padding: 0.5em;
+  background: #111;
+  color: #ddd;
+  font: 12px/1.4 Menlo, Consolas, monospace;
+  white-space: pre-wrap;
+}
+#logs-lines .stderr { color: #ef9a9a; }
+`
+
+const dashboardJS = `"use strict";
+
+var token = localStorage.getItem("spm-token") || "";
+var canWrite = false;
+var follow = null;
+var finalStates = {stopped: true, exited: true, failed: true};
+
+function $(id) { return document.getElementById(id); }
+
+function api(method, path, body) {
+  var headers = {};
+  if (token) headers["Authorization"] = "Bearer " + token;
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+  return fetch(path, {
+    method: method,
+    headers: headers,
+    body: body === undefined ? undefined : JSON.stringify(body)
+  }).then(function (res) {
+    if (res.ok) return res.status === 204 ? null : res.json();
+    return res.json().then(function (e) { throw new Error(e.Message || res.statusText); });
+  });
+}
+
+function showError(err) {
+  $("error").textContent = err ? err.message : "";
+  $("error").hidden = !err;
+}
+
+function checkAuth() {
+  return api("GET", "/v1/auth").then(function (res) {
+    canWrite = res.Write;
+    $("mode").textContent = canWrite ? "read-write" : "read-only";
+    $("auth").hidden = canWrite;
+  });
+}
+
+function duration(ms) {
+  var s = Math.floor(ms / 1000);
+  if (s < 60) return s + "s";
+  if (s < 3600) return Math.floor(s / 60) + "m" + (s % 60) + "s";
+  if (s < 86400) return Math.floor(s / 3600) + "h" + Math.floor(s % 3600 / 60) + "m";
+  return Math.floor(s / 86400) + "d" + Math.floor(s % 86400 / 3600) + "h";
+}
+
+function bytes(n) {
+  var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  var i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function cell(row, text, cls) {
+  var td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function action(td, task, name) {
+  var b = document.createElement("button");
+  b.type = "button";
+  b.textContent = name;
+  b.disabled = !canWrite;
+  b.onclick = function () {
+    b.disabled = true;
+    api("POST", "/v1/tasks/" + encodeURIComponent(task) + "/" + name).then(function () {
+      showError(null);
+    }, showError).then(refresh);
+  };
+  td.appendChild(b);
+}
+
+function render(tasks) {
+  var body = $("tasks");
+  body.textContent = "";
+  var now = Date.now();
+  tasks.forEach(function (t) {
+    var row = body.insertRow();
+    var name = document.createElement("a");
+    name.textContent = t.Name;
+    name.onclick = function () { openLogs(t.Name); };
+    row.insertCell().appendChild(name);
+    cell(row, t.State, t.State).title = t.Error || "";
+    var final = finalStates[t.State];
+    cell(row, t.Pid || "", "num");
+    cell(row, final ? "" : duration(now - Date.parse(t.Started)), "num");
+    cell(row, t.Restarts || 0, "num");
+    cell(row, final ? "" : (t.CPU || 0).toFixed(1) + "%", "num");
+    cell(row, final ? "" : bytes(t.Memory || 0), "num");
+    var td = row.insertCell();
+    if (final) {
+      action(td, t.Name, "start");
+    } else {
+      action(td, t.Name, "stop");
+      action(td, t.Name, "restart");
+    }
+  });
+}
+
+function refresh() {
+  return api("GET", "/v1/tasks").then(function (res) {
+    render(res.Tasks);
+  }, showError);
+}
+
+function closeLogs() {
+  if (follow) follow.abort();
+  follow = null;
+  $("logs").hidden = true;
+}
+
+function appendLine(line) {
+  var pre = $("logs-lines");
+  var atEnd = pre.scrollTop + pre.clientHeight >= pre.scrollHeight - 4;
+  var span = document.createElement("span");
+  span.className = line.Stream;
+  span.textContent = line.Text + "\n";
+  pre.appendChild(span);
+  while (pre.childNodes.length > 5000) pre.removeChild(pre.firstChild);
+  if (atEnd) pre.scrollTop = pre.scrollHeight;
+}
+
+function openLogs(task) {
+  closeLogs();
+  $("logs-task").textContent = task;
+  $("logs-lines").textContent = "";
+  $("logs").hidden = false;
+  var ctrl = new AbortController();
+  follow = ctrl;
+  var path = "/v1/tasks/" + encodeURIComponent(task) + "/logs?follow=1&tail=200";
+  fetch(path, {signal: ctrl.signal}).then(function (res) {
+    if (!res.ok) return res.json().then(function (e) { throw new Error(e.Message); });
+    var reader = res.body.getReader();
+    var decoder = new TextDecoder();
+    var rest = "";
+    function read() {
+      return reader.read().then(function (chunk) {
+        if (chunk.done) return;
+        var lines = (rest + decoder.decode(chunk.value, {stream: true})).split("\n");
+        rest = lines.pop();
+        lines.forEach(function (l) { if (l) appendLine(JSON.parse(l)); });
+        return read();
+      });
+    }
+    return read();
+  }).catch(function (err) {
+    if (err.name !== "AbortError") showError(err);
+  });
+}
+
+$("auth").onsubmit = function (e) {
+  e.preventDefault();
+  token = $("token").value;
+  localStorage.setItem("spm-token", token);
+  checkAuth().then(refresh, showError);
+};
+$("logs-close").onclick = closeLogs;
+
+var events = new EventSource("/v1/events");
+events.onmessage = refresh;
+["started", "ready", "unhealthy", "exited", "restarted", "stopped"].forEach(function (type) {
+  events.addEventListener(type, refresh);
+});
+
+checkAuth().then(refresh, showError);
+setInterval(refresh, 2000);
+`
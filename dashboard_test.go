@@ -0,0 +1,85 @@
+package spm
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	srv := httptest.NewServer(NewHTTPHandler(m, "secret"))
+	defer srv.Close()
+
+	get := func(path string, status int) (*http.Response, string) {
+		t.Helper()
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("GET %s: got status %d, want %d", path, res.StatusCode, status)
+		}
+		return res, string(b)
+	}
+
+	for path, contentType := range map[string]string{
+		"/":              "text/html; charset=utf-8",
+		"/dashboard.css": "text/css; charset=utf-8",
+		"/dashboard.js":  "application/javascript; charset=utf-8",
+	} {
+		res, body := get(path, http.StatusOK)
+		if got := res.Header.Get("Content-Type"); got != contentType {
+			t.Errorf("%s: got content type %s, want %s", path, got, contentType)
+		}
+		if res.Header.Get("Content-Security-Policy") == "" || res.Header.Get("X-Frame-Options") != "DENY" {
+			t.Errorf("%s: no security headers", path)
+		}
+		if body != dashboardFiles[path].content {
+			t.Errorf("%s: got another content", path)
+		}
+	}
+	get("/favicon.ico", http.StatusNotFound)
+
+	// without the token the dashboard is read-only
+	var auth AuthResult
+	if _, body := get("/v1/auth", http.StatusOK); json.Unmarshal([]byte(body), &auth) != nil || auth.Write {
+		t.Errorf("got auth %s", body)
+	}
+
+	// the tasks the dashboard polls carry the fields it shows
+	if err := m.Start(context.Background(), Task{Name: "web", Command: []string{"sleep", "30"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, body := get("/v1/tasks", http.StatusOK)
+	var raw struct{ Tasks []map[string]interface{} }
+	if err := json.Unmarshal([]byte(body), &raw); err != nil || len(raw.Tasks) != 1 {
+		t.Fatalf("got tasks %s, %v", body, err)
+	}
+	for _, field := range []string{"Name", "State", "Pid", "Started"} {
+		if _, ok := raw.Tasks[0][field]; !ok {
+			t.Errorf("no %s in task %s", field, body)
+		}
+	}
+	var got StatusResult
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	want, err := m.Status("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, w := got.Tasks[0], want[0]
+	if g.Name != w.Name || g.State != w.State || g.Pid != w.Pid || !g.Started.Equal(w.Started) || g.Restarts != w.Restarts {
+		t.Errorf("got task %+v, want %+v", g, w)
+	}
+}
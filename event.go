@@ -0,0 +1,109 @@
+package spm
+
+import (
+	"context"
+	"time"
+)
+
+// Types of events.
+const (
+	// EventStarted is sent once the command of a task has been started.
+	EventStarted = "started"
+	// EventReady is sent once the ready check of a task succeeded, right
+	// after EventStarted for tasks without one.
+	EventReady = "ready"
+	// EventExited is sent once a task has ended.
+	EventExited = "exited"
+	// EventRestarted is sent once a restarted task runs again.
+	EventRestarted = "restarted"
+	// EventUnhealthy is sent once per run when the ready check of a task
+	// fails.
+	EventUnhealthy = "unhealthy"
+	// EventStopped is sent once a task stopped on request.
+	EventStopped = "stopped"
+	// EventReloaded is sent when the definition of a task was reloaded
+	// from its Procfile, before it is started again.
+	EventReloaded = "reloaded"
+)
+
+// EventTypes are all types of events.
+var EventTypes = []string{
+	EventStarted, EventReady, EventUnhealthy, EventExited,
+	EventRestarted, EventStopped, EventReloaded,
+}
+
+// ValidEventType reports whether typ is a known type of events.
+func ValidEventType(typ string) bool {
+	for _, t := range EventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Event tells about a change of a task.
+type Event struct {
+	Type string
+	Task string
+	Time time.Time
+	Pid  int `json:",omitempty"`
+	// ExitCode is the exit code of an exited task.
+	ExitCode int `json:",omitempty"`
+	// By tells who stopped a task, see WithClient.
+	By string `json:",omitempty"`
+	// Error tells why a task is unhealthy.
+	Error string `json:",omitempty"`
+}
+
+type clientKey struct{}
+
+// WithClient returns a copy of ctx that names client as the origin of the
+// requests made with it, e.g. in the By of EventStopped. The daemon names
+// the user of a unix socket client, cn@host of a TLS client and http@host
+// of a REST API client.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// clientOf returns the client set by WithClient, empty if there is none.
+func clientOf(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// Subscribe returns a channel that receives the events of the manager and a
+// function that ends the subscription. Events that don't fit into the
+// buffer of the channel are dropped instead of holding up the manager.
+func (m *Manager) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	m.eventsMu.Lock()
+	if m.subscribers == nil {
+		m.subscribers = make(map[chan Event]bool)
+	}
+	m.subscribers[ch] = true
+	m.eventsMu.Unlock()
+
+	return ch, func() {
+		m.eventsMu.Lock()
+		if m.subscribers[ch] {
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+		m.eventsMu.Unlock()
+	}
+}
+
+func (m *Manager) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package spm
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// createFIFO replaces name with a FIFO and opens both of its ends. The write
+// end is opened for reading too: a task holding it keeps the FIFO open, so
+// its writes don't fail with EPIPE or SIGPIPE while no daemon reads them.
+// They block once the FIFO is full instead.
+func createFIFO(name string) (r, w *os.File, err error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err := unix.Mkfifo(name, 0600); err != nil {
+		return nil, nil, &os.PathError{Op: "mkfifo", Path: name, Err: err}
+	}
+	if r, err = openFIFO(name); err != nil {
+		return nil, nil, err
+	}
+	if w, err = os.OpenFile(name, os.O_RDWR, 0); err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, w, nil
+}
+
+// openFIFO opens the read end of the FIFO name without waiting for a writer.
+func openFIFO(name string) (*os.File, error) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+	return os.OpenFile(name, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+}
@@ -0,0 +1,18 @@
+// +build !linux
+
+package spm
+
+import (
+	"errors"
+	"os"
+)
+
+// createFIFO falls back to a pipe, tasks are only re-adopted on linux.
+func createFIFO(name string) (r, w *os.File, err error) {
+	return os.Pipe()
+}
+
+// openFIFO is only supported on linux.
+func openFIFO(name string) (*os.File, error) {
+	return nil, errors.New("output FIFOs are not supported on this platform")
+}
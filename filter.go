@@ -0,0 +1,178 @@
+package spm
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// LogFilter processes the lines of a stream of a task before they are
+// logged. Filters are chained, each passes the lines it keeps to next.
+type LogFilter interface {
+	Filter(line []byte, next func([]byte))
+	// Flush passes on what the filter held back, at the end of the stream.
+	Flush(next func([]byte))
+}
+
+// Types of log filters.
+const (
+	FilterStripANSI = "strip_ansi"
+	FilterRedact    = "redact"
+	FilterDedup     = "dedup"
+	FilterRateLimit = "rate_limit"
+)
+
+// DefaultRedaction replaces the matches of a redact filter.
+const DefaultRedaction = "[REDACTED]"
+
+// FilterConfig is a parsed log_filter directive.
+type FilterConfig struct {
+	Type string
+	// Pattern and Replace configure a redact filter.
+	Pattern string
+	Replace string
+	// Rate is the number of lines per second a rate_limit filter lets
+	// through, Burst how many more it lets through at once.
+	Rate  int
+	Burst int
+}
+
+// NewFilter creates the filter described by cfg. Lines dropped by a rate
+// limit are counted in dropped.
+func NewFilter(cfg FilterConfig, dropped *uint64) (LogFilter, error) {
+	switch cfg.Type {
+	case FilterStripANSI:
+		return stripANSIFilter{}, nil
+	case FilterRedact:
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		repl := cfg.Replace
+		if repl == "" {
+			repl = DefaultRedaction
+		}
+		return &redactFilter{re: re, repl: []byte(repl)}, nil
+	case FilterDedup:
+		return &dedupFilter{}, nil
+	case FilterRateLimit:
+		if cfg.Rate <= 0 {
+			return nil, fmt.Errorf("rate_limit must be a positive number")
+		}
+		burst := cfg.Burst
+		if burst <= 0 {
+			burst = cfg.Rate
+		}
+		return &rateLimitFilter{
+			rate:    float64(cfg.Rate),
+			burst:   float64(burst),
+			tokens:  float64(burst),
+			now:     time.Now,
+			dropped: dropped,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown log filter %s", cfg.Type)
+}
+
+type stripANSIFilter struct{}
+
+func (stripANSIFilter) Filter(line []byte, next func([]byte)) {
+	if bytes.IndexByte(line, '\033') >= 0 {
+		line = ansiEscape.ReplaceAll(line, nil)
+	}
+	next(line)
+}
+
+func (stripANSIFilter) Flush(next func([]byte)) {}
+
+type redactFilter struct {
+	re   *regexp.Regexp
+	repl []byte
+}
+
+func (f *redactFilter) Filter(line []byte, next func([]byte)) {
+	next(f.re.ReplaceAllLiteral(line, f.repl))
+}
+
+func (f *redactFilter) Flush(next func([]byte)) {}
+
+// dedupFilter collapses runs of identical lines into the first one and a
+// count of the repetitions.
+type dedupFilter struct {
+	last     []byte
+	repeated int
+}
+
+func (f *dedupFilter) Filter(line []byte, next func([]byte)) {
+	if f.last != nil && bytes.Equal(line, f.last) {
+		f.repeated++
+		return
+	}
+	f.Flush(next)
+	f.last = append(f.last[:0], line...)
+	next(line)
+}
+
+func (f *dedupFilter) Flush(next func([]byte)) {
+	if f.repeated > 0 {
+		next([]byte(fmt.Sprintf("last message repeated %d times", f.repeated)))
+		f.repeated = 0
+	}
+}
+
+// rateLimitFilter lets rate lines per second through, with bursts of up to
+// burst lines.
+type rateLimitFilter struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+	now         func() time.Time
+
+	dropped *uint64 // accessed atomically, all streams of the task
+	missed  int     // dropped since the last line let through
+}
+
+func (f *rateLimitFilter) Filter(line []byte, next func([]byte)) {
+	now := f.now()
+	if !f.last.IsZero() {
+		f.tokens += now.Sub(f.last).Seconds() * f.rate
+		if f.tokens > f.burst {
+			f.tokens = f.burst
+		}
+	}
+	f.last = now
+	if f.tokens < 1 {
+		f.missed++
+		if f.dropped != nil {
+			atomic.AddUint64(f.dropped, 1)
+		}
+		return
+	}
+	f.tokens--
+	f.Flush(next)
+	next(line)
+}
+
+func (f *rateLimitFilter) Flush(next func([]byte)) {
+	if f.missed > 0 {
+		next([]byte(fmt.Sprintf("rate limit dropped %d lines", f.missed)))
+		f.missed = 0
+	}
+}
+
+// filterChain passes line through filters and then to out.
+func filterChain(filters []LogFilter, out func([]byte)) (filter func([]byte), flush func()) {
+	next := out
+	flushes := func() {}
+	for i := len(filters) - 1; i >= 0; i-- {
+		f, n, fl := filters[i], next, flushes
+		next = func(line []byte) { f.Filter(line, n) }
+		flushes = func() {
+			f.Flush(n)
+			fl()
+		}
+	}
+	return next, flushes
+}
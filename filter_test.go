@@ -0,0 +1,197 @@
+package spm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func runFilters(t *testing.T, cfgs []FilterConfig, lines ...string) []string {
+	filters := make([]LogFilter, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		f, err := NewFilter(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filters = append(filters, f)
+	}
+	var got []string
+	filter, flush := filterChain(filters, func(line []byte) {
+		got = append(got, string(line))
+	})
+	for _, line := range lines {
+		filter([]byte(line))
+	}
+	flush()
+	return got
+}
+
+func TestLogFilters(t *testing.T) {
+	got := runFilters(t, []FilterConfig{
+		{Type: FilterStripANSI},
+		{Type: FilterRedact, Pattern: `token=\w+`, Replace: "token=***"},
+		{Type: FilterRedact, Pattern: `[\w.]+@[\w.]+`},
+		{Type: FilterDedup},
+	},
+		"\033[31mfailed\033[0m for bob@example.com",
+		"login token=abc123",
+		"login token=def456",
+		"login token=ghi789",
+		"done",
+		"done",
+	)
+	want := []string{
+		"failed for [REDACTED]",
+		"login token=***",
+		"last message repeated 2 times",
+		"done",
+		"last message repeated 1 times",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRateLimitFilter(t *testing.T) {
+	now := time.Date(2019, 4, 18, 0, 0, 0, 0, time.UTC)
+	var dropped uint64
+	f, err := NewFilter(FilterConfig{Type: FilterRateLimit, Rate: 2}, &dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.(*rateLimitFilter).now = func() time.Time { return now }
+
+	var got []string
+	filter, flush := filterChain([]LogFilter{f}, func(line []byte) {
+		got = append(got, string(line))
+	})
+	// a burst of 2 passes, the rest of the second is dropped
+	for _, line := range []string{"a", "b", "c", "d"} {
+		filter([]byte(line))
+	}
+	now = now.Add(time.Second)
+	filter([]byte("e"))
+	flush()
+
+	want := "a b rate limit dropped 2 lines e"
+	if s := strings.Join(got, " "); s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+	if dropped != 2 {
+		t.Errorf("dropped %d, want 2", dropped)
+	}
+}
+
+func TestLoggerSharedFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logging, err := NewLogging("web", dir, DefaultLogConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Filters = []FilterConfig{{Type: FilterRateLimit, Rate: 1, Burst: 4}}
+
+	// the burst is for stdout and stderr together
+	output := strings.Repeat("line\n", 10)
+	var wg sync.WaitGroup
+	for _, stream := range []string{Stdout, Stderr} {
+		wg.Add(1)
+		go func(stream string) {
+			defer wg.Done()
+			if err := logging.Output(strings.NewReader(output), stream); err != nil {
+				t.Error(err)
+			}
+		}(stream)
+	}
+	wg.Wait()
+	if err := logging.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := logging.Dropped(); dropped != 16 {
+		t.Errorf("dropped %d lines, want 16", dropped)
+	}
+}
+
+func TestLoggerDedupPerStream(t *testing.T) {
+	old := dedupTimeout
+	dedupTimeout = 50 * time.Millisecond
+	defer func() { dedupTimeout = old }()
+
+	dir, err := ioutil.TempDir("", "spm-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logging, err := NewLogging("web", dir, DefaultLogConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Filters = []FilterConfig{{Type: FilterDedup}}
+	var mirror safeBuffer
+	logging.Mirror = &mirror
+
+	// stderr repeats the line of stdout, which still holds its repeat
+	stdout, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- logging.Output(stdout, Stdout)
+	}()
+	io.WriteString(w, "same\nsame\n")
+	if err := logging.Output(strings.NewReader("same\n"), Stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	// the repeat of stdout is summed up while it is still open
+	summary := "web stdout | last message repeated 1 times\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(mirror.String(), summary) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no summary of the repeat in:\n%s", mirror.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	logging.Close()
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(mirror.String()), "\n") {
+		// drop the time
+		got = append(got, line[strings.Index(line, "web "):])
+	}
+	sort.Strings(got)
+	want := []string{"web stderr | same", "web stdout | last message repeated 1 times", "web stdout | same"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+// safeBuffer is a bytes.Buffer for concurrent use.
+type safeBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
@@ -0,0 +1,151 @@
+package spm
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// GrepQuery selects the log lines of GrepLog.
+type GrepQuery struct {
+	Task    string
+	Pattern *regexp.Regexp
+	// Since and Until limit the time of the lines, zero values don't.
+	Since, Until time.Time
+	// Context is the number of lines shown around every match.
+	Context int
+	// Stream, if not empty, selects the lines of that stream only.
+	Stream string
+}
+
+// inRange reports whether line was written between Since and Until. Lines
+// without time are only in an unlimited range.
+func (q GrepQuery) inRange(line LogLine) bool {
+	if q.Since.IsZero() && q.Until.IsZero() {
+		return true
+	}
+	if line.Time.IsZero() {
+		return false
+	}
+	return !line.Time.Before(q.Since) && (q.Until.IsZero() || !line.Time.After(q.Until))
+}
+
+// errUntil ends a search once lines are past q.Until.
+type errUntil struct{}
+
+func (errUntil) Error() string { return "past until" }
+
+// GrepLog searches the log of q.Task, all rotated backups included, and
+// passes the matching lines in chronological order to send. Lines around a
+// match are passed with Context set.
+func (m *Manager) GrepLog(q GrepQuery, send func(LogLine) error) error {
+	filename, err := m.logFileName(q.Task, q.Stream)
+	if err != nil {
+		return err
+	}
+	backups, err := logBackups(filename)
+	if err != nil {
+		return err
+	}
+	files := make([]string, 0, len(backups)+1)
+	for _, b := range backups {
+		// a backup holds the lines up to its rotation
+		if !q.Since.IsZero() && b.rotated.Before(q.Since) {
+			continue
+		}
+		files = append(files, b.name)
+	}
+	files = append(files, filename)
+
+	g := grepper{q: q, send: send}
+	for _, name := range files {
+		err := g.grepFile(name)
+		if _, ok := err.(errUntil); ok {
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// grepper keeps the context state across the files of a log.
+type grepper struct {
+	q    GrepQuery
+	send func(LogLine) error
+
+	before []LogLine // lines that may precede the next match
+	after  int       // lines still to pass after the last match
+	prev   time.Time
+}
+
+func (g *grepper) grepFile(name string) error {
+	f, err := openLog(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		s, err := r.ReadString('\n')
+		if s != "" {
+			if err := g.line(strings.TrimSuffix(s, "\n")); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (g *grepper) line(s string) error {
+	line := ParseLogLine(s)
+	line.Task = g.q.Task
+	if line.Time.IsZero() {
+		line.Time = g.prev
+	}
+	g.prev = line.Time
+
+	if g.q.Stream != "" && line.Stream != g.q.Stream {
+		return nil
+	}
+	if !g.q.Until.IsZero() && line.Time.After(g.q.Until) {
+		return errUntil{}
+	}
+	if !g.q.inRange(line) {
+		return nil
+	}
+
+	if g.q.Pattern.MatchString(line.Text) {
+		for _, l := range g.before {
+			l.Context = true
+			if err := g.send(l); err != nil {
+				return err
+			}
+		}
+		g.before = g.before[:0]
+		g.after = g.q.Context
+		return g.send(line)
+	}
+	if g.after > 0 {
+		g.after--
+		line.Context = true
+		return g.send(line)
+	}
+	if g.q.Context > 0 {
+		if len(g.before) == g.q.Context {
+			g.before = append(g.before[:0], g.before[1:]...)
+		}
+		g.before = append(g.before, line)
+	}
+	return nil
+}
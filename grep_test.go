@@ -0,0 +1,86 @@
+package spm
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func writeLog(t *testing.T, name string, gz bool, start time.Time, texts ...string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var b []byte
+	for i, text := range texts {
+		b = appendLogHeader(b, LogFormatRFC3339Nano, start.Add(time.Duration(i)*time.Minute), "worker", Stdout)
+		b = append(append(b, text...), '\n')
+	}
+	if !gz {
+		_, err = f.Write(b)
+	} else {
+		z := gzip.NewWriter(f)
+		if _, err = z.Write(b); err == nil {
+			err = z.Close()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrepLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-grep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2019, 4, 18, 0, 0, 0, 0, time.UTC)
+	filename := filepath.Join(dir, "worker.log")
+	// two backups, the older one compressed, and the active file
+	writeLog(t, filepath.Join(dir, "worker-2019-04-18T02-03-00.000.log.gz"), true, day.Add(2*time.Hour), "a error", "b", "c")
+	writeLog(t, filepath.Join(dir, "worker-2019-04-18T02-06-00.000.log"), false, day.Add(2*time.Hour+3*time.Minute), "d", "e error", "f")
+	writeLog(t, filename, false, day.Add(2*time.Hour+6*time.Minute), "g", "h error", "i")
+
+	m := NewManager()
+	m.loggers["worker"] = &Logger{filename: filename}
+
+	grep := func(q GrepQuery) (got []string) {
+		q.Task = "worker"
+		q.Pattern = regexp.MustCompile("error")
+		err := m.GrepLog(q, func(line LogLine) error {
+			if line.Context {
+				got = append(got, "-"+line.Text)
+			} else {
+				got = append(got, line.Text)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	equal := func(got []string, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		}
+	}
+
+	equal(grep(GrepQuery{}), "a error", "e error", "h error")
+	equal(grep(GrepQuery{Context: 1}), "a error", "-b", "-d", "e error", "-f", "-g", "h error", "-i")
+	equal(grep(GrepQuery{Since: day.Add(2*time.Hour + 4*time.Minute), Until: day.Add(2*time.Hour + 7*time.Minute)}), "e error", "h error")
+	equal(grep(GrepQuery{Since: day.Add(3 * time.Hour)}))
+}
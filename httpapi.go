@@ -0,0 +1,500 @@
+package spm
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListenHTTP listens for the HTTP API on addr, which is either the path of a
+// unix socket prefixed with "unix:" or a TCP address on the loopback
+// interface. Reading needs no authentication, so the API is never exposed
+// beyond the local host.
+func ListenHTTP(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !loopbackHost(host) {
+		return nil, fmt.Errorf("http address %s is not on localhost", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// removeStaleSocket removes the socket a crashed process left behind at
+// path, like Listen does. Sockets something still answers on and files of
+// other types are left alone.
+func removeStaleSocket(path string) error {
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("listen on %s: in use by another process", path)
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen on %s: not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// loopbackHost reports whether host is localhost or a loopback address.
+func loopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// httpAPI serves the REST API of a manager, see openAPI for its endpoints.
+type httpAPI struct {
+	m     *Manager
+	token string
+}
+
+// NewHTTPHandler returns the handler of the REST API and the dashboard of m.
+// Its requests behave like the requests on the socket of the daemon.
+//
+// Anyone may read, requests that change tasks need the bearer token in
+// token, unless they come over a unix socket. The API is read-only over TCP
+// when token is empty. Requests over TCP must name a loopback host in their
+// Host header, so that web pages can't reach the API by rebinding their DNS
+// names to 127.0.0.1.
+func NewHTTPHandler(m *Manager, token string) http.Handler {
+	api := &httpAPI{m: m, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tasks", api.tasks)
+	mux.HandleFunc("/v1/tasks/", api.task)
+	mux.HandleFunc("/v1/logs", api.logs)
+	mux.HandleFunc("/v1/events", api.events)
+	mux.HandleFunc("/v1/save", api.save)
+	mux.HandleFunc("/v1/resurrect", api.save)
+	mux.HandleFunc("/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, openAPI)
+	})
+	mux.Handle("/metrics", NewMetricsHandler(m))
+	mux.HandleFunc("/v1/auth", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, AuthResult{Write: api.canWrite(r)})
+	})
+	mux.HandleFunc("/", serveDashboard)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !overUnix(r) {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = strings.Trim(r.Host, "[]")
+			}
+			if !loopbackHost(host) {
+				writeHTTPError(w, &Error{Code: CodeForbidden, Message: "unknown host " + r.Host})
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !api.canWrite(r) {
+			writeHTTPError(w, &Error{Code: CodeForbidden, Message: "changing tasks needs a token"})
+			return
+		}
+		client := "http"
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			client += "@" + host
+		}
+		mux.ServeHTTP(w, r.WithContext(WithClient(r.Context(), client)))
+	})
+}
+
+// AuthResult tells what the client of the HTTP API may do.
+type AuthResult struct {
+	// Write is set when the client may change tasks.
+	Write bool
+}
+
+// overUnix reports whether r came over a unix socket.
+func overUnix(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// canWrite reports whether r may change tasks.
+func (api *httpAPI) canWrite(r *http.Request) bool {
+	if overUnix(r) {
+		return true
+	}
+	if api.token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(api.token)) == 1
+}
+
+// tasks lists the started tasks and starts new ones.
+func (api *httpAPI) tasks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		statuses, err := api.m.Status()
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, StatusResult{Tasks: statuses})
+	case http.MethodPost:
+		var p StartParams
+		if !readJSON(w, r, &p) {
+			return
+		}
+		tasks := p.Jobs
+		if p.Procfile != "" {
+			var err error
+			if tasks, err = LoadTasks(p.Procfile, p.Tasks); err != nil {
+				writeHTTPError(w, err)
+				return
+			}
+		}
+		if err := api.m.StartAll(r.Context(), tasks); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		allowMethod(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// task serves /v1/tasks/{name} and its actions.
+func (api *httpAPI) task(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/tasks/")
+	name, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	ctx := r.Context()
+
+	var err error
+	switch action {
+	case "":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+	case "logs":
+		query := r.URL.Query()
+		query.Set("task", name)
+		r.URL.RawQuery = query.Encode()
+		api.logs(w, r)
+		return
+	case "grep":
+		api.grep(w, r, name)
+		return
+	case "start", "stop", "restart", "rotate":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		switch action {
+		case "start":
+			err = api.m.StartAgain(ctx, name)
+		case "stop":
+			err = api.m.Stop(ctx, name)
+		case "restart":
+			err = api.m.Restart(ctx, name)
+		case "rotate":
+			err = api.m.Rotate(name)
+		}
+	case "scale":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		var p ScaleParams
+		if !readJSON(w, r, &p) {
+			return
+		}
+		err = api.m.Scale(ctx, name, p.Count)
+	default:
+		err = &Error{Code: CodeUnknownMethod, Message: "unknown action " + action}
+	}
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	statuses, err := api.m.Status(name)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses[0])
+}
+
+// logs returns the last lines of the logs, or streams them as JSON lines
+// until the client goes away when they are followed.
+func (api *httpAPI) logs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	q := LogQuery{
+		Tasks:  nonEmpty(query["task"]),
+		Stream: query.Get("stream"),
+		Raw:    queryBool(query.Get("raw")),
+	}
+	if len(q.Tasks) == 0 {
+		q.Tasks = api.m.KnownTasks()
+	}
+	q.Tail, _ = strconv.Atoi(query.Get("tail"))
+	if q.Tail <= 0 {
+		q.Tail = 200
+	}
+	if !queryBool(query.Get("follow")) {
+		lines, err := api.m.ReadLogs(q)
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, LogResult{Tasks: q.Tasks, Lines: lines})
+		return
+	}
+
+	// lines that don't exist are not worth a stream
+	for _, task := range q.Tasks {
+		if _, err := api.m.logFileName(task, q.Stream); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+	}
+	send := streamJSON(w)
+	_ = api.m.FollowLogs(r.Context(), q, func(line LogLine) error {
+		return send(line)
+	})
+}
+
+// grep streams the matching lines of the log of task as JSON lines.
+func (api *httpAPI) grep(w http.ResponseWriter, r *http.Request, task string) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	q := GrepQuery{Task: task, Stream: query.Get("stream")}
+	var err error
+	if q.Pattern, err = regexp.Compile(query.Get("pattern")); err != nil {
+		writeHTTPError(w, &Error{Code: CodeBadRequest, Message: err.Error()})
+		return
+	}
+	for key, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := query.Get(key); s != "" {
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				writeHTTPError(w, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("bad %s: %s", key, err)})
+				return
+			}
+		}
+	}
+	if s := query.Get("context"); s != "" {
+		if q.Context, err = strconv.Atoi(s); err != nil {
+			writeHTTPError(w, &Error{Code: CodeBadRequest, Message: "bad context " + s})
+			return
+		}
+	}
+	if _, err := api.m.logFileName(task, q.Stream); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	send := streamJSON(w)
+	_ = api.m.GrepLog(q, func(line LogLine) error {
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		default:
+		}
+		return send(line)
+	})
+}
+
+// events sends the events of the manager as server-sent events, selected by
+// the task and type parameters.
+func (api *httpAPI) events(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	p := EventsParams{Tasks: nonEmpty(query["task"]), Types: nonEmpty(query["type"])}
+	for _, typ := range p.Types {
+		if !ValidEventType(typ) {
+			writeHTTPError(w, &Error{Code: CodeBadRequest, Message: "unknown event type " + typ})
+			return
+		}
+	}
+	flusher, _ := w.(http.Flusher)
+
+	events, unsubscribe := api.m.Subscribe(64)
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			if !p.Match(e) {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// save serves /v1/save and /v1/resurrect.
+func (api *httpAPI) save(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var p SaveParams
+	if !readJSON(w, r, &p) {
+		return
+	}
+	filename := p.File
+	if filename == "" {
+		filename = DefaultDumpFile()
+	}
+	var err error
+	if r.URL.Path == "/v1/save" {
+		err = api.m.Save(filename)
+	} else {
+		err = api.m.Resurrect(r.Context(), filename)
+	}
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowMethod reports whether the method of r is one of methods, and
+// responds with 405 if it isn't.
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, &Error{
+		Code:    CodeUnknownMethod,
+		Message: fmt.Sprintf("method %s not allowed", r.Method),
+	})
+	return false
+}
+
+// readJSON decodes the body of r into v, an empty body leaves v as is. It
+// responds with 415 if the body is not JSON, which keeps web pages from
+// posting forms, or 400 if it is not valid, and reports false.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if typ, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || typ != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, &Error{
+			Code:    CodeBadRequest,
+			Message: "request body must be application/json",
+		})
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeHTTPError(w, &Error{Code: CodeBadRequest, Message: "bad request body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeHTTPError responds with err as an Error, with the HTTP status of its
+// code.
+func writeHTTPError(w http.ResponseWriter, err error) {
+	e := toError(err)
+	status := http.StatusInternalServerError
+	switch e.Code {
+	case CodeBadRequest:
+		status = http.StatusBadRequest
+	case CodeNotFound, CodeUnknownMethod:
+		status = http.StatusNotFound
+	case CodeForbidden:
+		status = http.StatusForbidden
+	}
+	writeJSON(w, status, e)
+}
+
+// streamJSON starts a chunked response of JSON lines and returns the
+// function sending them, each one is flushed right away.
+func streamJSON(w http.ResponseWriter) func(v interface{}) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	return func(v interface{}) error {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+}
+
+func queryBool(s string) bool {
+	b, _ := strconv.ParseBool(s)
+	return b
+}
+
+// nonEmpty drops the empty strings of values.
+func nonEmpty(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
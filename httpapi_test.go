@@ -0,0 +1,203 @@
+package spm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPAPI(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	srv := httptest.NewServer(NewHTTPHandler(m, "secret"))
+	defer srv.Close()
+
+	token, contentType, host := "secret", "application/json", ""
+	do := func(method, path, body string, status int, v interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if body != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s %s: got status %d, want %d", method, path, res.StatusCode, status)
+		}
+		if v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatalf("%s %s: %s", method, path, err)
+			}
+		}
+	}
+
+	var doc map[string]interface{}
+	do("GET", "/v1/openapi.json", "", 200, &doc)
+	if doc["openapi"] == nil || doc["paths"] == nil {
+		t.Error("bad openapi document")
+	}
+
+	// the dashboard is served at the root
+	do("GET", "/", "", 200, nil)
+	do("GET", "/dashboard.js", "", 200, nil)
+	do("GET", "/favicon.ico", "", 404, nil)
+
+	start := `{"Jobs":[{"Name":"web","Command":["sh","-c","echo hello; sleep 30"]}]}`
+	do("POST", "/v1/tasks", start, 204, nil)
+	var status TaskStatus
+	do("GET", "/v1/tasks/web", "", 200, &status)
+	if status.State != StateRunning || status.Pid == 0 {
+		t.Errorf("bad status %+v", status)
+	}
+	if runtime.GOOS == "linux" && status.Memory == 0 {
+		t.Errorf("no memory usage in status %+v", status)
+	}
+	var apiErr Error
+	do("GET", "/v1/tasks/db", "", 404, &apiErr)
+	if apiErr.Code != CodeNotFound {
+		t.Errorf("got error %+v for unknown task", apiErr)
+	}
+	do("DELETE", "/v1/tasks/web", "", 405, nil)
+	do("POST", "/v1/tasks/web/jump", "", 404, nil)
+
+	// reading needs no token, changing tasks does
+	var auth AuthResult
+	token = "wrong"
+	do("GET", "/v1/auth", "", 200, &auth)
+	if auth.Write {
+		t.Error("wrong token may write")
+	}
+	do("GET", "/v1/tasks/web", "", 200, nil)
+	do("POST", "/v1/tasks/web/stop", "", 403, nil)
+	token = "secret"
+	do("GET", "/v1/auth", "", 200, &auth)
+	if !auth.Write {
+		t.Error("token may not write")
+	}
+
+	// bodies must be JSON and hosts loopback names, so that web pages can't
+	// post forms or rebind their names to the API
+	contentType = "text/plain"
+	do("POST", "/v1/tasks/web/scale", `{"Count":2}`, 415, nil)
+	contentType = "application/json; charset=utf-8"
+	host = "evil.example:80"
+	do("GET", "/v1/tasks", "", 403, nil)
+	do("POST", "/v1/tasks/web/scale", `{"Count":2}`, 403, nil)
+	host = "localhost:8080"
+	do("GET", "/v1/tasks", "", 200, nil)
+	host = ""
+
+	var list StatusResult
+	do("POST", "/v1/tasks/web/scale", `{"Count":2}`, 200, nil)
+	do("GET", "/v1/tasks", "", 200, &list)
+	if len(list.Tasks) != 2 || list.Tasks[1].Name != "web.2" {
+		t.Errorf("got tasks %+v after scaling to 2", list.Tasks)
+	}
+	do("POST", "/v1/tasks/web/scale", `{"Count":1}`, 200, nil)
+	do("GET", "/v1/tasks/web.2", "", 200, &status)
+	if status.State != StateStopped {
+		t.Errorf("instance 2 is %s after scaling to 1", status.State)
+	}
+
+	// followed logs are streamed as JSON lines
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/tasks/web/logs?follow=1", nil)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line LogLine
+	if err := json.NewDecoder(res.Body).Decode(&line); err != nil || line.Text != "hello" {
+		t.Errorf("got line %+v, %v", line, err)
+	}
+	res.Body.Close()
+
+	// events arrive as server-sent events
+	req, _ = http.NewRequest("GET", srv.URL+"/v1/events?type=exited", nil)
+	res, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	do("POST", "/v1/tasks/web/stop", "", 200, &status)
+	if status.State != StateStopped {
+		t.Errorf("stopped task is %s", status.State)
+	}
+	r := bufio.NewReader(res.Body)
+	if s, _ := r.ReadString('\n'); s != "event: exited\n" {
+		t.Errorf("got %q, want exited event", s)
+	}
+	if s, _ := r.ReadString('\n'); !strings.HasPrefix(s, `data: {"Type":"exited","Task":"web"`) {
+		t.Errorf("got event data %q", s)
+	}
+}
+
+func TestListenHTTPUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files that are not sockets are never removed
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenHTTP("unix:" + file); err == nil {
+		t.Error("listening on a regular file")
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != "data" {
+		t.Errorf("regular file was touched: %q, %v", b, err)
+	}
+
+	path := filepath.Join(dir, "http.sock")
+	ln, err := ListenHTTP("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nor is a socket that is in use
+	if _, err := ListenHTTP("unix:" + path); err == nil {
+		t.Error("listening on a socket in use")
+	}
+	if c, err := net.Dial("unix", path); err != nil {
+		t.Errorf("socket in use was removed: %v", err)
+	} else {
+		c.Close()
+	}
+	ln.Close()
+
+	// but a stale one is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = ListenHTTP("unix:" + path)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	ln.Close()
+}
@@ -1,11 +1,12 @@
 package spm
 
 import (
-	"bufio"
 	"fmt"
-
-	"math/rand"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mattn/go-isatty"
@@ -13,84 +14,418 @@ import (
 )
 
 type Logger struct {
-	Prefix   []byte
-	LogColor int
+	filtered uint64 // lines dropped by filters, accessed atomically
+
+	name   string
+	format string
+	output string
+	raw    bool
+	// maxLine and flushPartial configure splitLines.
+	maxLine      int
+	flushPartial time.Duration
+	pid          int32 // accessed atomically
+	LogColor     int
 
-	Logfile  *lumberjack.Logger
+	Logfile *lumberjack.Logger
+	// Errfile receives stderr if it goes to its own file, otherwise nil.
+	Errfile  *lumberjack.Logger
 	filename string
+	errname  string
+	// out and errOut queue the lines of Logfile and Errfile.
+	out, errOut *logWriter
+
+	// Mirror, if not nil, receives every prefixed line as well.
+	Mirror io.Writer
+	// Sinks receive every line, e.g. to forward it to syslog. They are
+	// called while the output of the task is read, so they must not block.
+	Sinks []LogSink
+	// Filters process the lines before they are written anywhere.
+	Filters []FilterConfig
+	// Instance is the instance of the task in JSON lines, zero is 1.
+	Instance int
+	// OnError, if not nil, is told when lines could not be written to the
+	// log files, at most once a minute per file.
+	OnError func(error)
+
+	// shared are the rate limits of Filters by their index, created once
+	// for stdout and stderr. filterMu serializes the use of all filters,
+	// streams counts the streams that use them.
+	filterMu sync.Mutex
+	shared   map[int]LogFilter
+	streams  int
 }
 
-func NewLogging(name string) (*Logger, error) {
-	linkname := "/tmp/spm/" + name + ".log"
-	logfile := &lumberjack.Logger{
-		Filename:   linkname,
-		MaxSize:    1024, //mb
+// LogConfig configures the log file of a task and its rotation.
+type LogConfig struct {
+	// Path of the log file, relative paths are resolved against the log
+	// directory of the daemon.
+	Path string
+	// StderrPath, if set, is a separate file for stderr of the task.
+	StderrPath string
+	// Format is the time format of log lines, one of the LogFormat
+	// constants.
+	Format string
+	// Output is the encoding of log lines, one of the LogOutput constants.
+	Output     string
+	MaxSize    int // megabytes
+	MaxBackups int
+	MaxAge     int // days
+	Compress   bool
+	// Buffer is the number of lines queued for writing.
+	Buffer int
+	// Overflow is what happens to lines when the queue is full, one of the
+	// Overflow constants.
+	Overflow string
+	// MaxLine is the length in bytes after which lines are split.
+	MaxLine int
+	// FlushPartial is how long output without a trailing newline is held
+	// back, 0 waits for the newline.
+	FlushPartial time.Duration
+	// Raw writes the output exactly as it was emitted, without time,
+	// task and stream of the lines. Raw output isn't split into lines, so
+	// it skips the filters and sinks of the task, the parser rejects them.
+	Raw bool
+}
+
+// DefaultLogConfig returns the rotation settings of tasks without a log block.
+func DefaultLogConfig() LogConfig {
+	return LogConfig{
+		MaxSize:    1024,
 		MaxBackups: 10,
-		MaxAge:     7, // days
-		Compress:   false,
+		MaxAge:     7,
+		Buffer:     DefaultLogBuffer,
+		Overflow:   OverflowBlock,
+
+		MaxLine:      DefaultMaxLine,
+		FlushPartial: DefaultFlushPartial,
 	}
+}
 
-	// create random log color code
-	code := genColorCode()
+// DefaultLogDir is where task logs are written unless configured otherwise.
+func DefaultLogDir() string {
+	return filepath.Join(Dir(), "log")
+}
 
-	prefix := loggerPrefix(code, name)
+// NewLogging creates the logger of task name. The log file is cfg.Path or
+// <name>.log, resolved against dir.
+func NewLogging(name, dir string, cfg LogConfig) (*Logger, error) {
+	linkname := resolveLogPath(cfg.Path, name+".log", dir)
+	logfile := newLogfile(linkname, cfg)
 
-	return &Logger{
-		Prefix:   []byte(prefix),
+	code := TaskColor(name)
+
+	l := &Logger{
+		name:     name,
+		format:   cfg.Format,
+		output:   cfg.Output,
+		raw:      cfg.Raw,
 		LogColor: code,
 		Logfile:  logfile,
 		filename: linkname,
-	}, nil
+		out:      newLogWriter(logfile, cfg.Buffer, cfg.Overflow),
+
+		maxLine:      cfg.MaxLine,
+		flushPartial: cfg.FlushPartial,
+	}
+	l.out.onError = l.writeFailed
+	if cfg.StderrPath != "" {
+		l.errname = resolveLogPath(cfg.StderrPath, "", dir)
+		l.Errfile = newLogfile(l.errname, cfg)
+		l.errOut = newLogWriter(l.Errfile, cfg.Buffer, cfg.Overflow)
+		l.errOut.onError = l.writeFailed
+	}
+	return l, nil
+}
+
+// writeFailed passes an error of writing the log files on to OnError.
+func (l *Logger) writeFailed(err error) {
+	if l.OnError != nil {
+		l.OnError(err)
+	}
+}
+
+func resolveLogPath(path, def, dir string) string {
+	if path == "" {
+		path = def
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
+
+func newLogfile(filename string, cfg LogConfig) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+	}
 }
 
 func (l *Logger) FileName() string {
 	return l.filename
 }
 
-// Write writes given string into Logfile
-func (l *Logger) Write(s []byte) error {
-	if _, err := l.Logfile.Write(s); err != nil {
-		return err
+// ErrFileName returns the file stderr is written to, which is FileName
+// unless stderr has its own file.
+func (l *Logger) ErrFileName() string {
+	if l.Errfile != nil {
+		return l.errname
 	}
+	return l.filename
+}
+
+// Write queues given string to be written into Logfile
+func (l *Logger) Write(s []byte) error {
+	l.out.WriteLine(s)
 	return nil
 }
 
-var ln = []byte("\n")
+// mirrorMu keeps lines of different tasks apart on a shared Mirror.
+var mirrorMu sync.Mutex
 
-// Output reads the in then writes into both stdout and logfile
-func (l *Logger) Output(in *bufio.Scanner) error {
-	for in.Scan() {
-		_ = l.Write(l.Prefix)
-		_ = l.Write(in.Bytes())
-		_ = l.Write(ln)
+// Output reads the in, which is the stream stdout or stderr of the task,
+// passes its lines through the filters and writes them into both the
+// logfile and Mirror.
+func (l *Logger) Output(in io.Reader, stream string) error {
+	file := l.out
+	if stream == Stderr && l.errOut != nil {
+		file = l.errOut
+	}
+	if l.raw {
+		return l.outputRaw(in, file)
+	}
+	// files never get colors, a terminal Mirror does
+	color := false
+	if f, ok := l.Mirror.(*os.File); ok {
+		color = isatty.IsTerminal(f.Fd())
+	}
+	instance := l.Instance
+	if instance == 0 {
+		instance = 1
 	}
 
-	if err := in.Err(); err != nil {
+	var line, mirror []byte
+	write := func(msg []byte) {
+		// every line carries the time it was written at
+		now := time.Now()
+		for _, sink := range l.Sinks {
+			// sinks queue their lines, one that is down doesn't hold up
+			// the task
+			_ = sink.WriteLine(now, l.name, stream, l.Pid(), msg)
+		}
+		if l.output == LogOutputJSON {
+			line = appendJSONLogLine(line[:0], l.format, now, l.name, instance, stream, l.Pid(), msg)
+			line = append(line, '\n')
+			file.WriteLine(line)
+			if l.Mirror != nil {
+				mirrorMu.Lock()
+				_, _ = l.Mirror.Write(line)
+				mirrorMu.Unlock()
+			}
+			return
+		}
+
+		header := appendLogHeader(nil, l.format, now, l.name, stream)
+		line = append(append(append(line[:0], header...), msg...), '\n')
+		file.WriteLine(line)
+		if l.Mirror != nil {
+			mirror = mirror[:0]
+			if color {
+				mirror = append(mirror, fmt.Sprintf("\033[38;5;%dm%s\033[0m", l.LogColor, header)...)
+			} else {
+				mirror = append(mirror, header...)
+			}
+			mirror = append(append(mirror, msg...), '\n')
+			mirrorMu.Lock()
+			_, _ = l.Mirror.Write(mirror)
+			mirrorMu.Unlock()
+		}
+	}
+
+	filter, flush, err := l.filterChain(write)
+	if err != nil {
 		return err
 	}
+	err = splitLines(in, l.maxLine, l.flushPartial, filter)
+	flush()
+	return err
+}
 
-	return nil
+// dedupTimeout is how long repeats held back by a dedup filter wait for
+// their summary at most.
+var dedupTimeout = 5 * time.Second
+
+// filterChain returns the filters of l in front of out, for the stream out
+// writes. Rate limits are shared by both streams, so that they hold for the
+// whole output of the task, and flushed once the last stream ended. The
+// other filters, like dedup, are per stream. What they hold back is flushed
+// at the end of the stream or after dedupTimeout.
+func (l *Logger) filterChain(out func([]byte)) (filter func([]byte), flush func(), err error) {
+	if len(l.Filters) == 0 {
+		return out, func() {}, nil
+	}
+	l.filterMu.Lock()
+	defer l.filterMu.Unlock()
+	if l.shared == nil {
+		l.shared = make(map[int]LogFilter)
+	}
+	filters := make([]LogFilter, 0, len(l.Filters))
+	for i, cfg := range l.Filters {
+		if cfg.Type == FilterRateLimit {
+			if l.shared[i] == nil {
+				f, err := NewFilter(cfg, &l.filtered)
+				if err != nil {
+					return nil, nil, err
+				}
+				l.shared[i] = sharedFilter{LogFilter: f, streams: &l.streams}
+			}
+			filters = append(filters, l.shared[i])
+			continue
+		}
+		f, err := NewFilter(cfg, &l.filtered)
+		if err != nil {
+			return nil, nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	l.streams++
+	chain, flushChain := filterChain(filters, out)
+	var (
+		timer *time.Timer
+		ended bool
+	)
+	filter = func(line []byte) {
+		l.filterMu.Lock()
+		defer l.filterMu.Unlock()
+		chain(line)
+		if timer == nil {
+			timer = time.AfterFunc(dedupTimeout, func() {
+				l.filterMu.Lock()
+				defer l.filterMu.Unlock()
+				if !ended {
+					flushChain()
+				}
+				timer = nil
+			})
+		}
+	}
+	flush = func() {
+		l.filterMu.Lock()
+		defer l.filterMu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		ended = true
+		l.streams--
+		flushChain()
+	}
+	return filter, flush, nil
 }
 
-func (l *Logger) Close() error {
-	if err := l.Logfile.Close(); err != nil {
-		return err
+// sharedFilter is a filter of both streams of a logger, it is flushed with
+// the last of them only.
+type sharedFilter struct {
+	LogFilter
+	streams *int // protected by the filterMu of the logger
+}
+
+func (f sharedFilter) Flush(next func([]byte)) {
+	if *f.streams == 0 {
+		f.LogFilter.Flush(next)
 	}
+}
 
-	return nil
+// outputRaw copies in to file and Mirror as it comes.
+func (l *Logger) outputRaw(in io.Reader, file *logWriter) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			file.WriteLine(buf[:n])
+			if l.Mirror != nil {
+				mirrorMu.Lock()
+				_, _ = l.Mirror.Write(buf[:n])
+				mirrorMu.Unlock()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
-// LoggerPrefix wraps given string and time with unix color code, as prefix
-func loggerPrefix(code int, s string) string {
-	t := time.Now().Format("15:04:05 PM")
-	if isatty.IsTerminal(os.Stdout.Fd()) {
-		return fmt.Sprintf("\033[38;5;%dm%s %s | \033[0m", code, t, s)
+// SetPid sets the process id that is recorded in JSON log lines.
+func (l *Logger) SetPid(pid int) {
+	atomic.StoreInt32(&l.pid, int32(pid))
+}
+
+// Pid returns the process id set by SetPid.
+func (l *Logger) Pid() int {
+	return int(atomic.LoadInt32(&l.pid))
+}
+
+// Dropped returns how many lines were dropped because the log files could
+// not keep up with the task, writing them failed or a rate limit was hit.
+func (l *Logger) Dropped() uint64 {
+	n := atomic.LoadUint64(&l.filtered) + l.out.Dropped()
+	if l.errOut != nil {
+		n += l.errOut.Dropped()
+	}
+	return n
+}
+
+// Written returns how many lines and bytes were written to the log files.
+func (l *Logger) Written() (lines, bytes uint64) {
+	lines, bytes = l.out.Written()
+	if l.errOut != nil {
+		errLines, errBytes := l.errOut.Written()
+		lines, bytes = lines+errLines, bytes+errBytes
+	}
+	return lines, bytes
+}
+
+// Rotate closes the current log file, moves it aside and starts a new one.
+// Lines queued before are written to the old file.
+func (l *Logger) Rotate() error {
+	l.out.Flush()
+	if l.errOut != nil {
+		l.errOut.Flush()
 	}
-	return fmt.Sprintf("%s %s | ", t, s)
+	if l.Errfile != nil {
+		if err := l.Errfile.Rotate(); err != nil {
+			return err
+		}
+	}
+	return l.Logfile.Rotate()
 }
 
-func genColorCode() (code int) {
-	rand.Seed(int64(time.Now().Nanosecond()))
-	code = rand.Intn(231) + 1
-	return
+// Close writes the queued lines and closes the log files and sinks. Each of
+// them is closed even if another fails, the first error is returned.
+func (l *Logger) Close() error {
+	l.out.Close()
+	if l.errOut != nil {
+		l.errOut.Close()
+	}
+	var first error
+	for _, sink := range l.Sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	if l.Errfile != nil {
+		if err := l.Errfile.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := l.Logfile.Close(); err != nil && first == nil {
+		first = err
+	}
+	return first
 }
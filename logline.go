@@ -0,0 +1,242 @@
+package spm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Streams of a task.
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Time formats of log lines.
+const (
+	LogFormatRFC3339Nano = "rfc3339nano"
+	LogFormatEpoch       = "epoch" // seconds since 1970 with fraction
+	LogFormatNone        = "none"
+)
+
+// Encodings of log lines.
+const (
+	LogOutputText = "text"
+	LogOutputJSON = "json" // one JSON object per line
+)
+
+// ValidLogOutput reports whether output is one of the LogOutput constants.
+func ValidLogOutput(output string) bool {
+	return output == LogOutputText || output == LogOutputJSON
+}
+
+// ValidLogFormat reports whether format is one of the LogFormat constants.
+func ValidLogFormat(format string) bool {
+	switch format {
+	case LogFormatRFC3339Nano, LogFormatEpoch, LogFormatNone:
+		return true
+	}
+	return false
+}
+
+// appendLogHeader appends the prefix of a log line to b, it is the time t in
+// format followed by task and stream. The empty format is RFC3339Nano.
+func appendLogHeader(b []byte, format string, t time.Time, task, stream string) []byte {
+	switch format {
+	case LogFormatNone:
+	case LogFormatEpoch:
+		b = append(b, fmt.Sprintf("%d.%09d ", t.Unix(), t.Nanosecond())...)
+	default:
+		b = append(t.AppendFormat(b, time.RFC3339Nano), ' ')
+	}
+	b = append(append(append(b, task...), ' '), stream...)
+	return append(b, " | "...)
+}
+
+// LogLine is a line of a task log file.
+type LogLine struct {
+	Time   time.Time
+	Task   string
+	Stream string
+	Text   string
+	// Raw is the line as written to the file, if it was asked for.
+	Raw string `json:",omitempty"`
+	// Context is set for lines around a match of a search.
+	Context bool `json:",omitempty"`
+}
+
+// jsonLogLine is a line of a log file in LogOutputJSON.
+type jsonLogLine struct {
+	TS       json.RawMessage `json:"ts,omitempty"`
+	Task     string          `json:"task"`
+	Instance int             `json:"instance"`
+	Stream   string          `json:"stream"`
+	Pid      int             `json:"pid,omitempty"`
+	Msg      json.RawMessage `json:"msg"`
+}
+
+// appendJSONLogLine appends msg as a JSON log line to b. A msg that is a
+// JSON object or array itself is nested rather than escaped.
+func appendJSONLogLine(b []byte, format string, t time.Time, task string, instance int, stream string, pid int, msg []byte) []byte {
+	line := jsonLogLine{
+		Task:     task,
+		Instance: instance,
+		Stream:   stream,
+		Pid:      pid,
+	}
+	switch format {
+	case LogFormatNone:
+	case LogFormatEpoch:
+		line.TS = json.RawMessage(fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond()))
+	default:
+		line.TS = json.RawMessage(`"` + t.Format(time.RFC3339Nano) + `"`)
+	}
+	if trimmed := strings.TrimSpace(string(msg)); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(msg) {
+		line.Msg = json.RawMessage(msg)
+	} else {
+		line.Msg, _ = marshalJSON(string(msg))
+	}
+	out, err := marshalJSON(line)
+	if err != nil {
+		// msg could not be nested after all
+		line.Msg, _ = marshalJSON(string(msg))
+		out, _ = marshalJSON(line)
+	}
+	return append(b, out...)
+}
+
+// marshalJSON is json.Marshal without escaping of HTML characters, log
+// lines are not embedded in HTML.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// parseJSONLogLine parses a line written in LogOutputJSON.
+func parseJSONLogLine(s string) (LogLine, bool) {
+	var j jsonLogLine
+	if err := json.Unmarshal([]byte(s), &j); err != nil || j.Task == "" {
+		return LogLine{}, false
+	}
+	l := LogLine{Task: j.Task, Stream: j.Stream, Text: string(j.Msg)}
+	if l.Stream == "" {
+		l.Stream = Stdout
+	}
+	var text string
+	if err := json.Unmarshal(j.Msg, &text); err == nil {
+		l.Text = text
+	}
+	ts := string(j.TS)
+	if unquoted, err := strconv.Unquote(ts); err == nil {
+		ts = unquoted
+	}
+	l.Time = parseLogTime(ts)
+	return l, true
+}
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;?]*[ -/]*[@-~]")
+
+// stripANSI removes terminal escape sequences from s.
+func stripANSI(s string) string {
+	if strings.IndexByte(s, '\033') < 0 {
+		return s
+	}
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// ParseLogLine splits a line written by Logger into its parts. The prefix of
+// a line holds its time followed by task and stream, lines in an unknown
+// format end up in Text as stdout.
+func ParseLogLine(s string) LogLine {
+	if strings.HasPrefix(s, "{") {
+		if l, ok := parseJSONLogLine(s); ok {
+			return l
+		}
+	}
+	i := strings.Index(s, " | ")
+	if i < 0 {
+		return LogLine{Stream: Stdout, Text: s}
+	}
+	l := LogLine{
+		Stream: Stdout,
+		Text:   strings.TrimPrefix(s[i+3:], "\033[0m"),
+	}
+	fields := strings.Fields(stripANSI(s[:i]))
+	if n := len(fields); n > 0 && (fields[n-1] == Stdout || fields[n-1] == Stderr) {
+		l.Stream = fields[n-1]
+		fields = fields[:n-1]
+	}
+	if n := len(fields); n > 0 {
+		l.Task = fields[n-1]
+		l.Time = parseLogTime(strings.Join(fields[:n-1], " "))
+	}
+	return l
+}
+
+// logTimeLayouts are tried in order, "15:04:05 PM" is the time of the task
+// start written by earlier versions.
+var logTimeLayouts = []string{time.RFC3339Nano, "15:04:05 PM"}
+
+// parseLogTime parses the time of a log line, the zero time is returned
+// when it can not be parsed.
+func parseLogTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if i := strings.IndexByte(s, '.'); i > 0 && i < len(s)-1 {
+		sec, err1 := strconv.ParseInt(s[:i], 10, 64)
+		nsec, err2 := strconv.ParseInt((s[i+1:] + "000000000")[:9], 10, 64)
+		if err1 == nil && err2 == nil {
+			return time.Unix(sec, nsec)
+		}
+	}
+	for _, layout := range logTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// TaskColor returns the terminal color code of task, which is the same for
+// every run of the task.
+func TaskColor(task string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(task))
+	// skip the first 16 system colors and the greys at the end
+	return 16 + int(h.Sum32()%216)
+}
+
+// mergeLogLines interleaves lists of lines, each in time order, into a
+// single list in time order.
+func mergeLogLines(lists ...[]LogLine) []LogLine {
+	var total int
+	for _, l := range lists {
+		total += len(l)
+	}
+	merged := make([]LogLine, 0, total)
+	for len(merged) < total {
+		next := -1
+		for i, l := range lists {
+			if len(l) == 0 {
+				continue
+			}
+			if next < 0 || l[0].Time.Before(lists[next][0].Time) {
+				next = i
+			}
+		}
+		merged = append(merged, lists[next][0])
+		lists[next] = lists[next][1:]
+	}
+	return merged
+}
@@ -0,0 +1,110 @@
+package spm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	at := time.Date(0, 1, 1, 15, 4, 5, 0, time.Local)
+	tests := []struct {
+		line string
+		want LogLine
+	}{
+		{"15:04:05 PM web stdout | hello", LogLine{Time: at, Task: "web", Stream: Stdout, Text: "hello"}},
+		{"\033[38;5;12m15:04:05 PM web stderr | \033[0mfailed | twice", LogLine{Time: at, Task: "web", Stream: Stderr, Text: "failed | twice"}},
+		{"15:04:05 PM web | old format", LogLine{Time: at, Task: "web", Stream: Stdout, Text: "old format"}},
+		{"no prefix", LogLine{Stream: Stdout, Text: "no prefix"}},
+	}
+	for _, tt := range tests {
+		if got := ParseLogLine(tt.line); got != tt.want {
+			t.Errorf("ParseLogLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestMergeLogLines(t *testing.T) {
+	at := func(sec int, task string) LogLine {
+		return LogLine{Time: time.Unix(int64(sec), 0), Task: task}
+	}
+	web := []LogLine{at(1, "web"), at(3, "web"), at(3, "web"), at(6, "web")}
+	worker := []LogLine{at(2, "worker"), at(3, "worker"), at(7, "worker")}
+
+	got := mergeLogLines(web, worker)
+	want := []LogLine{at(1, "web"), at(2, "worker"), at(3, "web"), at(3, "web"), at(3, "worker"), at(6, "web"), at(7, "worker")}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLogHeaderRoundTrip(t *testing.T) {
+	at := time.Date(2019, 4, 18, 15, 4, 5, 123456789, time.Local)
+	for _, format := range []string{LogFormatRFC3339Nano, LogFormatEpoch, LogFormatNone} {
+		line := string(appendLogHeader(nil, format, at, "web", Stderr)) + "listening"
+		got := ParseLogLine(line)
+		want := LogLine{Time: at, Task: "web", Stream: Stderr, Text: "listening"}
+		if format == LogFormatNone {
+			want.Time = time.Time{}
+		}
+		if !got.Time.Equal(want.Time) || got.Task != want.Task || got.Stream != want.Stream || got.Text != want.Text {
+			t.Errorf("%s: ParseLogLine(%q) = %+v, want %+v", format, line, got, want)
+		}
+	}
+}
+
+func TestJSONLogLine(t *testing.T) {
+	at := time.Date(2019, 4, 18, 15, 4, 5, 123456789, time.UTC)
+	tests := []struct {
+		msg, want, text string
+	}{
+		{"plain <text>", `{"ts":"2019-04-18T15:04:05.123456789Z","task":"web","instance":1,"stream":"stderr","pid":42,"msg":"plain <text>"}`, "plain <text>"},
+		{`{"level":"info"}`, `{"ts":"2019-04-18T15:04:05.123456789Z","task":"web","instance":1,"stream":"stderr","pid":42,"msg":{"level":"info"}}`, `{"level":"info"}`},
+		{`{"broken"`, `{"ts":"2019-04-18T15:04:05.123456789Z","task":"web","instance":1,"stream":"stderr","pid":42,"msg":"{\"broken\""}`, `{"broken"`},
+	}
+	for _, tt := range tests {
+		line := string(appendJSONLogLine(nil, LogFormatRFC3339Nano, at, "web", 1, Stderr, 42, []byte(tt.msg)))
+		if line != tt.want {
+			t.Errorf("got %s, want %s", line, tt.want)
+		}
+		got := ParseLogLine(line)
+		if !got.Time.Equal(at) || got.Task != "web" || got.Stream != Stderr || got.Text != tt.text {
+			t.Errorf("ParseLogLine(%s) = %+v", line, got)
+		}
+	}
+}
+
+func TestJSONLogInstance(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	task := Task{Name: "web", Command: []string{"sh", "-c", "echo hello; sleep 30"}, LogOutput: LogOutputJSON}
+	if err := m.Start(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Scale(ctx, "web", 2); err != nil {
+		t.Fatal(err)
+	}
+	for instance, name := range []string{"web", "web.2"} {
+		want := fmt.Sprintf(`"task":%q,"instance":%d,`, name, instance+1)
+		var lines []LogLine
+		for deadline := time.Now().Add(5 * time.Second); len(lines) == 0 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			var err error
+			lines, err = m.ReadLogs(LogQuery{Tasks: []string{name}, Tail: 1, Raw: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(lines) != 1 || !strings.Contains(lines[0].Raw, want) {
+			t.Errorf("got lines %+v of %s, want %s", lines, name, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package spm
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Overflow policies of a log writer whose queue is full.
+const (
+	// OverflowBlock makes the task wait until the queue has room.
+	OverflowBlock = "block"
+	// OverflowDropOldest drops the oldest queued line.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDrop drops the new line.
+	OverflowDrop = "drop"
+)
+
+// DefaultLogBuffer is the number of lines queued for a log file by default.
+const DefaultLogBuffer = 1024
+
+// logErrorInterval is the shortest time between two reported errors of a
+// log writer, a full disk fails every batch.
+const logErrorInterval = time.Minute
+
+// ValidOverflow reports whether policy is one of the Overflow constants.
+func ValidOverflow(policy string) bool {
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDrop:
+		return true
+	}
+	return false
+}
+
+// logWriter queues whole lines and writes them to w in batches from its own
+// goroutine, so a task doesn't wait on the disk for every line it prints.
+// The queue holds at most size lines, what happens when it is full is
+// decided by policy.
+type logWriter struct {
+	w      io.Writer
+	policy string
+	// onError, if not nil, is told about failed writes, at most once per
+	// logErrorInterval. The lines of a failed batch count as dropped.
+	onError  func(error)
+	reported time.Time
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signals changes of the queue and of writing
+	ring    [][]byte   // slots keep their buffers to be reused
+	head, n int
+	writing bool
+	closed  bool
+	dropped uint64
+	// lines and bytes count what has been written to w
+	lines, bytes uint64
+	done         chan struct{}
+}
+
+func newLogWriter(w io.Writer, size int, policy string) *logWriter {
+	if size <= 0 {
+		size = DefaultLogBuffer
+	}
+	if policy == "" {
+		policy = OverflowBlock
+	}
+	lw := &logWriter{
+		w:      w,
+		policy: policy,
+		ring:   make([][]byte, size),
+		done:   make(chan struct{}),
+	}
+	lw.cond = sync.NewCond(&lw.mu)
+	go lw.run()
+	return lw
+}
+
+// WriteLine queues a copy of line. Lines written after Close are dropped.
+func (lw *logWriter) WriteLine(line []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	for lw.policy == OverflowBlock && lw.n == len(lw.ring) && !lw.closed {
+		lw.cond.Wait()
+	}
+	if lw.closed {
+		return
+	}
+	if lw.n == len(lw.ring) {
+		lw.dropped++
+		if lw.policy == OverflowDrop {
+			return
+		}
+		lw.head = (lw.head + 1) % len(lw.ring)
+		lw.n--
+	}
+	i := (lw.head + lw.n) % len(lw.ring)
+	lw.ring[i] = append(lw.ring[i][:0], line...)
+	lw.n++
+	lw.cond.Broadcast()
+}
+
+func (lw *logWriter) run() {
+	defer close(lw.done)
+	var batch []byte
+	lw.mu.Lock()
+	for {
+		for lw.n == 0 && !lw.closed {
+			lw.cond.Wait()
+		}
+		if lw.n == 0 {
+			lw.mu.Unlock()
+			return
+		}
+		batch = batch[:0]
+		lines := uint64(lw.n)
+		for ; lw.n > 0; lw.n-- {
+			batch = append(batch, lw.ring[lw.head]...)
+			lw.head = (lw.head + 1) % len(lw.ring)
+		}
+		lw.writing = true
+		lw.cond.Broadcast()
+		lw.mu.Unlock()
+
+		// the task goes on while the batch is written
+		_, err := lw.w.Write(batch)
+		if err != nil && lw.onError != nil && time.Since(lw.reported) >= logErrorInterval {
+			lw.reported = time.Now()
+			lw.onError(err)
+		}
+
+		lw.mu.Lock()
+		if err != nil {
+			lw.dropped += lines
+		} else {
+			lw.lines += lines
+			lw.bytes += uint64(len(batch))
+		}
+		lw.writing = false
+		lw.cond.Broadcast()
+	}
+}
+
+// Flush waits until every queued line has been written.
+func (lw *logWriter) Flush() {
+	lw.mu.Lock()
+	for lw.n > 0 || lw.writing {
+		lw.cond.Wait()
+	}
+	lw.mu.Unlock()
+}
+
+// Dropped returns how many lines were dropped because the queue was full or
+// writing them failed.
+func (lw *logWriter) Dropped() uint64 {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.dropped
+}
+
+// Written returns how many lines and bytes have been written.
+func (lw *logWriter) Written() (lines, bytes uint64) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.lines, lw.bytes
+}
+
+// Close writes the queued lines and stops the writer. It doesn't close w.
+func (lw *logWriter) Close() {
+	lw.mu.Lock()
+	lw.closed = true
+	lw.cond.Broadcast()
+	lw.mu.Unlock()
+	<-lw.done
+}
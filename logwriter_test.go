@@ -0,0 +1,139 @@
+package spm
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// stallWriter holds up the first write until release is closed.
+type stallWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	b       strings.Builder
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		<-w.release
+	})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.b.Write(p)
+}
+
+func TestLogWriterOverflow(t *testing.T) {
+	for _, test := range []struct {
+		policy  string
+		want    string
+		dropped uint64
+	}{
+		{OverflowDrop, "a\nb\nc\n", 1},
+		{OverflowDropOldest, "a\nc\nd\n", 1},
+		{OverflowBlock, "a\nb\nc\nd\n", 0},
+	} {
+		w := &stallWriter{started: make(chan struct{}), release: make(chan struct{})}
+		lw := newLogWriter(w, 2, test.policy)
+		lw.WriteLine([]byte("a\n"))
+		<-w.started
+		// a is being written, b and c fill the queue
+		lw.WriteLine([]byte("b\n"))
+		lw.WriteLine([]byte("c\n"))
+		if test.policy == OverflowBlock {
+			go func() {
+				close(w.release)
+			}()
+		}
+		lw.WriteLine([]byte("d\n"))
+		if test.policy != OverflowBlock {
+			close(w.release)
+		}
+		lw.Close()
+
+		if got := w.b.String(); got != test.want {
+			t.Errorf("%s: wrote %q, want %q", test.policy, got, test.want)
+		}
+		if got := lw.Dropped(); got != test.dropped {
+			t.Errorf("%s: dropped %d, want %d", test.policy, got, test.dropped)
+		}
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestLogWriterFailure(t *testing.T) {
+	var errs []error
+	lw := newLogWriter(failWriter{}, 8, OverflowBlock)
+	lw.onError = func(err error) { errs = append(errs, err) }
+	lw.WriteLine([]byte("a\n"))
+	lw.WriteLine([]byte("b\n"))
+	lw.Flush()
+	lw.WriteLine([]byte("c\n"))
+	lw.Close()
+
+	if got := lw.Dropped(); got != 3 {
+		t.Errorf("dropped %d lines of failed writes, want 3", got)
+	}
+	if lines, bytes := lw.Written(); lines != 0 || bytes != 0 {
+		t.Errorf("counted %d lines, %d bytes of failed writes as written", lines, bytes)
+	}
+	// the second batch fails within logErrorInterval of the first
+	if len(errs) != 1 {
+		t.Errorf("got errors %v, want one", errs)
+	}
+}
+
+var benchLine = []byte("2019-04-18T02:03:04.123456789Z worker stdout | GET /index.html 200 0.002s\n")
+
+func benchLogfile(b *testing.B) (*lumberjack.Logger, func()) {
+	dir, err := ioutil.TempDir("", "spm-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	logfile := &lumberjack.Logger{Filename: filepath.Join(dir, "worker.log"), MaxSize: 1024}
+	return logfile, func() {
+		logfile.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// BenchmarkLogDirect writes every line straight to the log file like the
+// writer used to, in three writes.
+func BenchmarkLogDirect(b *testing.B) {
+	logfile, cleanup := benchLogfile(b)
+	defer cleanup()
+	header, text := benchLine[:46], benchLine[46:len(benchLine)-1]
+	b.SetBytes(int64(len(benchLine)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logfile.Write(header)
+		logfile.Write(text)
+		logfile.Write([]byte{'\n'})
+	}
+}
+
+// BenchmarkLogBuffered queues the lines to be written in batches.
+func BenchmarkLogBuffered(b *testing.B) {
+	logfile, cleanup := benchLogfile(b)
+	defer cleanup()
+	lw := newLogWriter(logfile, DefaultLogBuffer, OverflowBlock)
+	b.SetBytes(int64(len(benchLine)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lw.WriteLine(benchLine)
+	}
+	lw.Close()
+}
@@ -1,42 +1,132 @@
 package spm
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/hpcloud/tail"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Manager struct {
-	mu    sync.Mutex // protects following
-	Tasks map[string]Task
+	// StateFile is where the managed tasks are persisted so that a restarted
+	// daemon can pick them up again, the FIFOs of their output are kept in
+	// the directory output next to it. Empty disables persistence.
+	StateFile string
+	stateMu   sync.Mutex // serializes writes of StateFile
+
+	// LogDir is the directory task logs are written to.
+	LogDir string
+	// LogFormat is the time format of log lines of tasks that don't have
+	// their own.
+	LogFormat string
+	// LogOutput is the encoding of log lines of tasks that don't have
+	// their own.
+	LogOutput string
+
+	// StopTimeout is how long a stopped task may take to exit before its
+	// process group is killed. Zero waits forever.
+	StopTimeout time.Duration
+
+	// Mirror receives the prefixed output of every task in addition to
+	// its log file, e.g. os.Stdout when running as a container entrypoint.
+	Mirror io.Writer
+
+	// Backoff is the delay before a task is restarted by its restart policy.
+	// It doubles with every restart in a row, up to MaxBackoff. A task that
+	// ran for longer than MaxBackoff starts over. Zero uses the defaults.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// CriticalExit, if not nil, receives the exit code of a critical task
+	// that ended for good without being stopped.
+	CriticalExit chan int
+
+	// Log receives the messages of the manager, nil uses the standard
+	// logger of the log package.
+	Log *log.Logger
+
+	// Requests counts the requests of clients of the daemon, reported by
+	// WriteMetrics. Listeners record into it through their Metrics.
+	Requests RequestMetrics
+
+	eventsMu    sync.Mutex
+	subscribers map[chan Event]bool
+
+	childMu  sync.Mutex // serializes starting and reaping of child processes
+	children map[int]bool
+
+	mu       sync.Mutex         // protects following
+	procs    map[string]*proc   // every started task, until started again
+	loggers  map[string]*Logger // last logger of every task, running or not
+	shutdown bool
+	seq      uint64
 }
 
 func NewManager() *Manager {
 	return &Manager{
-		Tasks: make(map[string]Task),
+		LogDir:   DefaultLogDir(),
+		procs:    make(map[string]*proc),
+		loggers:  make(map[string]*Logger),
+		children: make(map[int]bool),
+	}
+}
+
+func (m *Manager) backoff() time.Duration {
+	if m.Backoff > 0 {
+		return m.Backoff
+	}
+	return DefaultBackoff
+}
+
+func (m *Manager) maxBackoff() time.Duration {
+	if m.MaxBackoff > 0 {
+		return m.MaxBackoff
+	}
+	return DefaultMaxBackoff
+}
+
+// logf writes a message to Log.
+func (m *Manager) logf(format string, v ...interface{}) {
+	if m.Log != nil {
+		m.Log.Output(2, fmt.Sprintf(format, v...))
+		return
 	}
+	log.Output(2, fmt.Sprintf(format, v...))
 }
 
-func (m *Manager) StartAll(tasks []Task) {
+// StartAll starts tasks one after another. A task that fails to start
+// doesn't keep the others from starting, the first error is returned.
+func (m *Manager) StartAll(ctx context.Context, tasks []Task) error {
+	var first error
 	for _, task := range tasks {
-		m.Start(task)
+		if err := m.Start(ctx, task); err != nil {
+			m.logf("start task `%s`: %s", task.Name, err)
+			if first == nil {
+				first = fmt.Errorf("start task %s: %s", task.Name, err)
+			}
+		}
 	}
+	return first
 }
 
-func setupCommand(task Task, cmd []string, pw io.Writer) (*exec.Cmd, error) {
+func setupCommand(task Task, cmd []string, stdout, stderr io.Writer) (*exec.Cmd, error) {
 	c := exec.Command(cmd[0], cmd[1:]...)
 	if err := setupUserAndGroup(c, task); err != nil {
 		return nil, fmt.Errorf("failed to set up running user: %s", err)
 	}
-	c.Stderr = pw
-	c.Stdout = pw
+	c.Stderr = stderr
+	c.Stdout = stdout
 	c.Env = make([]string, 0, 100)
 	for _, e := range os.Environ() {
 		if !strings.HasPrefix(e, "HOME=") {
@@ -50,140 +140,899 @@ func setupCommand(task Task, cmd []string, pw io.Writer) (*exec.Cmd, error) {
 	return c, nil
 }
 
-func (m *Manager) Start(task Task) {
+// Start runs the need commands of task and starts its command. ctx bounds
+// the need commands, not the life of the task.
+func (m *Manager) Start(ctx context.Context, task Task) error {
 	if !task.Valid() {
-		log.Println("task", task.Name, "包含无效命令")
-		return
+		return fmt.Errorf("task %s has no valid command", task.Name)
 	}
+	p, err := m.newProc(task)
+	if err != nil {
+		return err
+	}
+	started := make(chan error, 1)
+	go p.supervise(ctx, nil, started)
+	return <-started
+}
 
-	_, exists := m.Tasks[task.Name]
-	if exists {
-		log.Println(fmt.Sprintf("wont start task '%s' because already running", task.Name))
-		return
+// newProc reserves the name of task for a new supervisor.
+func (m *Manager) newProc(task Task) (*proc, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, exists := m.procs[task.Name]; exists && !p.final() {
+		return nil, fmt.Errorf("task %s is already running", task.Name)
 	}
+	m.seq++
+	p := &proc{
+		m:     m,
+		task:  task,
+		seq:   m.seq,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		state: StateStarting,
+	}
+	m.procs[task.Name] = p
+	return p, nil
+}
 
-	logging, err := NewLogging(task.Name)
+// launch runs the need commands of task and starts its command with its
+// output going to a new logger.
+func (m *Manager) launch(ctx context.Context, task Task) (*procRun, error) {
+	logging, err := m.newLogger(task)
 	if err != nil {
-		log.Fatal(err)
-	} else {
-		task.Logger = logging
+		return nil, err
 	}
+	r := &procRun{logger: logging}
 
-	pr, pw, err := os.Pipe()
+	pr, pw, err := m.outputPipe(task.Name, Stdout)
 	if err != nil {
-		log.Fatal(err)
+		logging.Close()
+		return nil, err
 	}
-	// read command's stdout line by line
-	in := bufio.NewScanner(pr)
+	epr, epw, err := m.outputPipe(task.Name, Stderr)
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		logging.Close()
+		return nil, err
+	}
+	m.readOutput(task, r, pr, epr)
+
+	c, err := m.startTask(ctx, task, pw, epw)
+	// the children hold their own copies of the write ends, ours are closed
+	// so that the readers end with the task
+	pw.Close()
+	epw.Close()
+	if err != nil {
+		m.closeLogger(task, r)
+		return nil, err
+	}
+
+	r.process = c.Process
+	r.pid = c.Process.Pid
+	r.started = time.Now()
+	r.startTime, _ = processStartTime(r.pid)
+	r.wait = make(chan error, 1)
+	r.ended = make(chan struct{})
+	logging.SetPid(r.pid)
 	go func() {
-		if err := task.Logger.Output(in); err != nil {
-			log.Fatal(err)
-		}
-		fmt.Println("logger stoped")
+		r.wait <- m.waitCmd(c)
 	}()
+	return r, nil
+}
 
-	for i := range task.Need {
-		cmd, err := setupCommand(task, task.Need[i], pw)
+// readOutput logs stdout and stderr of the command of r line by line.
+func (m *Manager) readOutput(task Task, r *procRun, stdout, stderr *os.File) {
+	r.output = new(sync.WaitGroup)
+	r.output.Add(2)
+	for f, stream := range map[*os.File]string{stdout: Stdout, stderr: Stderr} {
+		go func(f *os.File, stream string) {
+			defer r.output.Done()
+			defer f.Close()
+			if err := r.logger.Output(f, stream); err != nil {
+				m.logf("read %s of task `%s`: %s", stream, task.Name, err)
+			}
+		}(f, stream)
+	}
+}
+
+// outputPipe returns the pipe stream of task is written to. With a
+// StateFile it is a FIFO next to it, which the task keeps open for reading
+// as well, so that its output survives a crash of the daemon until the next
+// one opens the FIFO again, see Restore.
+func (m *Manager) outputPipe(task, stream string) (r, w *os.File, err error) {
+	if m.StateFile == "" {
+		return os.Pipe()
+	}
+	return createFIFO(m.outputFIFO(task, stream))
+}
+
+// outputFIFO returns the name of the FIFO of stream of task.
+func (m *Manager) outputFIFO(task, stream string) string {
+	return filepath.Join(filepath.Dir(m.StateFile), "output", task+"."+stream)
+}
+
+// removeOutput removes the FIFOs of task once it won't run again.
+func (m *Manager) removeOutput(task string) {
+	if m.StateFile == "" {
+		return
+	}
+	for _, stream := range []string{Stdout, Stderr} {
+		if err := os.Remove(m.outputFIFO(task, stream)); err != nil && !os.IsNotExist(err) {
+			m.logf("remove output of task `%s`: %s", task, err)
+		}
+	}
+}
+
+// startTask runs the need commands of task and starts its command with
+// stdout and stderr.
+func (m *Manager) startTask(ctx context.Context, task Task, stdout, stderr io.Writer) (*exec.Cmd, error) {
+	for _, need := range task.Need {
+		cmd, err := setupCommand(task, need, stdout, stderr)
+		if err != nil {
+			return nil, fmt.Errorf("set up command %s: %s", strings.Join(need, " "), err)
+		}
+		if err := m.runCmd(ctx, cmd); err != nil {
+			if err == ctx.Err() {
+				return nil, err
+			}
+			return nil, fmt.Errorf("command %s: %s", strings.Join(need, " "), err)
+		}
+	}
+	c, err := setupCommand(task, task.Command, stdout, stderr)
+	if err != nil {
+		return nil, fmt.Errorf("set up command %s: %s", strings.Join(task.Command, " "), err)
+	}
+	if err := m.startCmd(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReadyInterval is the time between two ready checks of a task.
+const ReadyInterval = time.Second
+
+// checkReady runs the ready check of task until it succeeds and sends
+// EventReady, unless r ends first. The first failure sends EventUnhealthy.
+func (m *Manager) checkReady(task Task, r *procRun) {
+	for unhealthy := false; len(task.Ready) > 0; {
+		cmd, err := setupCommand(task, task.Ready, ioutil.Discard, ioutil.Discard)
 		if err != nil {
-			log.Fatalf("setup command %s faield, error:%s\n", strings.Join(task.Need[i], " "), err)
+			m.logf("ready check of task `%s`: %s", task.Name, err)
+			return
 		}
-		if err := cmd.Run(); err != nil {
-			log.Fatalf("execute command %s failed, error: %s\n", strings.Join(task.Need[i], " "), err)
+		err = m.runCmd(context.Background(), cmd)
+		if err == nil {
+			break
+		}
+		if !unhealthy {
+			unhealthy = true
+			select {
+			case <-r.ended:
+				return
+			default:
+				m.emit(Event{Type: EventUnhealthy, Task: task.Name, Pid: r.pid, Error: err.Error()})
+			}
+		}
+		select {
+		case <-r.ended:
+			return
+		case <-time.After(ReadyInterval):
 		}
 	}
-	c, err := setupCommand(task, task.Command, pw)
+	select {
+	case <-r.ended:
+	default:
+		m.emit(Event{Type: EventReady, Task: task.Name, Pid: r.pid})
+	}
+}
+
+// newLogger creates the logger of task with its sinks and remembers it as
+// the last logger of the task.
+func (m *Manager) newLogger(task Task) (*Logger, error) {
+	logging, err := NewLogging(task.Name, m.LogDir, m.logConfig(task))
 	if err != nil {
-		log.Fatalf("execute command %s of task %s failed, error: %s\n", strings.Join(task.Command, " "), task.Name, err)
+		return nil, err
+	}
+	logging.Mirror = m.Mirror
+	logging.Filters = task.LogFilters
+	logging.Instance = task.Instance
+	logging.OnError = func(err error) {
+		m.logf("write log of task `%s`: %s, its lines are dropped", task.Name, err)
+	}
+	for _, cfg := range task.LogSinks {
+		sink, err := NewSink(cfg)
+		if err != nil {
+			return nil, err
+		}
+		logging.Sinks = append(logging.Sinks, newSinkQueue(sink))
 	}
-	task.NotifyEnd = make(chan bool)
-	task.Cmd = c
 
 	m.mu.Lock()
-	m.Tasks[task.Name] = task
+	m.loggers[task.Name] = logging
 	m.mu.Unlock()
+	return logging, nil
+}
 
-	log.Println(fmt.Sprintf("task `%s` has been started", task.Name))
+// logConfig returns the log configuration of task completed with the
+// defaults of the manager.
+func (m *Manager) logConfig(task Task) LogConfig {
+	cfg := task.logConfig()
+	cfg.Format = task.LogFormat
+	if cfg.Format == "" {
+		cfg.Format = m.LogFormat
+	}
+	cfg.Output = task.LogOutput
+	if cfg.Output == "" {
+		cfg.Output = m.LogOutput
+	}
+	return cfg
+}
+
+// startCmd starts c and registers it as a child, so that the reaper leaves
+// it to c.Wait.
+func (m *Manager) startCmd(c *exec.Cmd) error {
+	m.childMu.Lock()
+	defer m.childMu.Unlock()
 	if err := c.Start(); err != nil {
-		log.Println(err)
-		go m.taskEnded(task)
-		return
+		return err
 	}
+	m.children[c.Process.Pid] = true
+	return nil
+}
+
+func (m *Manager) waitCmd(c *exec.Cmd) error {
+	err := c.Wait()
+	m.childMu.Lock()
+	delete(m.children, c.Process.Pid)
+	m.childMu.Unlock()
+	return err
+}
 
+// runCmd runs c to its end, it is killed when ctx ends first.
+func (m *Manager) runCmd(ctx context.Context, c *exec.Cmd) error {
+	if err := m.startCmd(c); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
 	go func() {
-		if err := c.Wait(); err != nil {
-			log.Println(err)
-		}
-		m.taskEnded(task)
+		done <- m.waitCmd(c)
 	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = c.Process.Kill()
+		<-done
+		return ctx.Err()
+	}
 }
 
-func (m *Manager) taskEnded(task Task) {
-	m.mu.Lock()
-	delete(m.Tasks, task.Name)
-	m.mu.Unlock()
-	if err := task.Logger.Close(); err != nil {
-		log.Println("close task.Logger:", err)
+// closeLogger closes the logger of r once its output has been read.
+func (m *Manager) closeLogger(task Task, r *procRun) {
+	// the last lines may still be on their way, unless a process that
+	// outlived the task holds on to the pipes
+	if r.output != nil {
+		done := make(chan struct{})
+		go func() {
+			r.output.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}
+	if err := r.logger.Close(); err != nil {
+		m.logf("close logger of task `%s`: %s", task.Name, err)
 	}
-	log.Println(fmt.Sprintf("task `%s` ended", task.Name))
-	task.NotifyEnd <- true
 }
 
-func (m *Manager) Stop(task string) {
+// Stop stops task and waits for it to end. When ctx ends first, the task
+// is left to end on its own and ctx.Err() is returned.
+func (m *Manager) Stop(ctx context.Context, task string) error {
+	return m.stop(ctx, task, syscall.SIGTERM)
+}
+
+// stop asks the task to stop with sig and waits for its final state. A task
+// that is being stopped already is waited for as well.
+func (m *Manager) stop(ctx context.Context, task string, sig os.Signal) error {
 	m.mu.Lock()
-	j, exists := m.Tasks[task]
+	p := m.procs[task]
 	m.mu.Unlock()
-	if !exists {
-		return
+	if p == nil || !p.requestStop(sig, clientOf(ctx)) {
+		return &NotFoundError{Task: task, Reason: "is not running"}
 	}
-	//pid, _ := syscall.Getpgid(j.Cmd.Process.Pid)
-	//if err := syscall.Kill(-pid, syscall.SIGTERM);err != nil {
-	//	log.Println(err)
-	//}
-	if err := j.Cmd.Process.Signal(syscall.SIGTERM); err != nil {
-		log.Println(err)
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	<-j.NotifyEnd
 }
 
-func (m *Manager) StopAll() {
-	var wg sync.WaitGroup
-	for task := range m.Tasks {
-		wg.Add(1)
+// StopAll stops all tasks at once and waits for them to end.
+func (m *Manager) StopAll(ctx context.Context) error {
+	tasks := m.List()
+	errc := make(chan error, len(tasks))
+	for _, task := range tasks {
 		go func(task string) {
-			m.Stop(task)
-			wg.Done()
+			errc <- m.Stop(ctx, task)
 		}(task)
 	}
 
-	wg.Wait()
+	var first error
+	for range tasks {
+		// tasks that ended meanwhile are not an error
+		if err := <-errc; err != nil && first == nil {
+			if _, ok := err.(*NotFoundError); !ok {
+				first = err
+			}
+		}
+	}
+	return first
 }
 
+// Shutdown forwards sig to the tasks one by one in reverse start order and
+// waits for each to end. The tasks stay in the state file, so that they are
+// restored by the next daemon.
+func (m *Manager) Shutdown(ctx context.Context, sig os.Signal) error {
+	m.mu.Lock()
+	m.shutdown = true
+	procs := make([]*proc, 0, len(m.procs))
+	for _, p := range m.procs {
+		procs = append(procs, p)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(procs, func(i, j int) bool { return procs[i].seq > procs[j].seq })
+	ctx = WithClient(ctx, "shutdown")
+	for _, p := range procs {
+		err := m.stop(ctx, p.task.Name, sig)
+		if _, ok := err.(*NotFoundError); err != nil && !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the names of the tasks that are not in a final state.
 func (m *Manager) List() (tasks []string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	for task := range m.Tasks {
-		tasks = append(tasks, task)
+	for name, p := range m.procs {
+		if !p.final() {
+			tasks = append(tasks, name)
+		}
 	}
+	sort.Strings(tasks)
 	return tasks
 }
 
-// ReadLog reads last n lines of the file that corresponds to job.
-func (m *Manager) ReadLog(task string, n int) (lines []string) {
-	_, exists := m.Tasks[task]
+// Restart stops task, if it is still running, and starts it again, reloaded
+// from its Procfile if it came from one.
+func (m *Manager) Restart(ctx context.Context, task string) error {
+	t, err := m.reload(task)
+	if err != nil {
+		return err
+	}
+	if err := m.Stop(ctx, task); err != nil {
+		if _, ok := err.(*NotFoundError); !ok {
+			return err
+		}
+	}
+	if err := m.Start(ctx, t); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	p := m.procs[task]
+	m.mu.Unlock()
+	m.emit(Event{Type: EventRestarted, Task: task, Pid: p.status(nil).Pid})
+	return nil
+}
+
+// StartAgain starts a task that was started before and is in a final state
+// now, reloaded from its Procfile if it came from one.
+func (m *Manager) StartAgain(ctx context.Context, task string) error {
+	t, err := m.reload(task)
+	if err != nil {
+		return err
+	}
+	return m.Start(ctx, t)
+}
+
+// reload returns the last definition of task, reloaded from its Procfile if
+// it came from one.
+func (m *Manager) reload(task string) (Task, error) {
+	m.mu.Lock()
+	p, exists := m.procs[task]
+	m.mu.Unlock()
 	if !exists {
-		lines = append(lines, "task "+task+" is not running")
-		return
+		return Task{}, &NotFoundError{Task: task, Reason: "has not been started"}
+	}
+	t := p.task
+	if t.Procfile == "" || t.Instance > 1 {
+		return t, nil
 	}
+	tasks, err := LoadTasks(t.Procfile, []string{task})
+	if err != nil {
+		return Task{}, err
+	}
+	m.emit(Event{Type: EventReloaded, Task: task})
+	return tasks[0], nil
+}
 
-	filename := m.Tasks[task].Logger.FileName()
-	lines = append(lines, fmt.Sprintf("tail %s of %d lines", filename, n))
-	t, err := tail.TailFile(filename, tail.Config{Follow: false})
+// Scale runs count instances of task, which must have been started before.
+// The task itself is the first instance, the others are copies named
+// task.2, task.3 and so on that get their number in SPM_INSTANCE. Instances
+// above count are stopped.
+func (m *Manager) Scale(ctx context.Context, task string, count int) error {
+	if count < 0 {
+		return fmt.Errorf("bad instance count %d", count)
+	}
+	base, err := m.reload(task)
 	if err != nil {
-		lines = append(lines, err.Error())
+		return err
+	}
+	if base.Instance > 1 {
+		return fmt.Errorf("task %s is an instance of a scaled task", task)
+	}
+
+	m.mu.Lock()
+	var extra []string
+	for name, p := range m.procs {
+		if i := instanceOf(name, task); i > count && !p.final() {
+			extra = append(extra, name)
+		}
+	}
+	m.mu.Unlock()
+	for _, name := range extra {
+		if err := m.Stop(ctx, name); err != nil {
+			if _, ok := err.(*NotFoundError); !ok {
+				return err
+			}
+		}
+	}
+
+	running := make(map[string]bool)
+	for _, name := range m.List() {
+		running[name] = true
+	}
+	for i := 1; i <= count; i++ {
+		t := base.instance(i)
+		if running[t.Name] {
+			continue
+		}
+		if err := m.Start(ctx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TaskStatus describes a started task.
+type TaskStatus struct {
+	Name string
+	// State is one of the State constants.
+	State    string
+	Pid      int `json:",omitempty"`
+	Started  time.Time
+	Command  []string
+	Procfile string
+	// Restarts counts the restarts by the restart policy.
+	Restarts int `json:",omitempty"`
+	// ExitCode is the exit code of the last run.
+	ExitCode int `json:",omitempty"`
+	// Error tells why a failed task failed.
+	Error   string `json:",omitempty"`
+	LogFile string `json:",omitempty"`
+	// LogDropped is the number of lines of the current run that didn't make
+	// it into its log.
+	LogDropped uint64 `json:",omitempty"`
+	// CPU is the CPU usage of the process group of a running task in
+	// percent of one core, and Memory its resident memory in bytes.
+	CPU    float64 `json:",omitempty"`
+	Memory uint64  `json:",omitempty"`
+}
+
+// Status returns the status of the tasks listed in names, or of all started
+// tasks when names is empty. Tasks in a final state are included until they
+// are started again.
+func (m *Manager) Status(names ...string) ([]TaskStatus, error) {
+	m.mu.Lock()
+	if len(names) == 0 {
+		for name := range m.procs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	procs := make([]*proc, 0, len(names))
+	for _, name := range names {
+		p, exists := m.procs[name]
+		if !exists {
+			m.mu.Unlock()
+			return nil, &NotFoundError{Task: name, Reason: "has not been started"}
+		}
+		procs = append(procs, p)
+	}
+	m.mu.Unlock()
+
+	usages := procUsages(procs)
+	statuses := make([]TaskStatus, len(procs))
+	for i, p := range procs {
+		statuses[i] = p.status(usages)
+	}
+	return statuses, nil
+}
+
+// procUsages returns the usage of the process groups of the running procs.
+// It is best effort, usage is missing without /proc.
+func procUsages(procs []*proc) map[int]usage {
+	var pgrps []int
+	for _, p := range procs {
+		if pid := p.pid(); pid != 0 {
+			pgrps = append(pgrps, pid)
+		}
+	}
+	usages, _ := groupUsages(pgrps)
+	return usages
+}
+
+// NotFoundError is returned for tasks that are unknown or not running.
+type NotFoundError struct {
+	Task   string
+	Reason string // e.g. "is not running"
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("task %s %s", e.Task, e.Reason)
+}
+
+// Rotate forces a rotation of the log file of task.
+func (m *Manager) Rotate(task string) error {
+	m.mu.Lock()
+	p := m.procs[task]
+	m.mu.Unlock()
+	var logger *Logger
+	if p != nil {
+		p.mu.Lock()
+		if p.run != nil {
+			logger = p.run.logger
+		}
+		p.mu.Unlock()
+	}
+	if logger == nil {
+		return &NotFoundError{Task: task, Reason: "is not running"}
+	}
+	return logger.Rotate()
+}
+
+// logFileName returns the file the stream of task is logged to. Tasks that
+// ended are still known by their last logger.
+func (m *Manager) logFileName(task, stream string) (string, error) {
+	m.mu.Lock()
+	logger, exists := m.loggers[task]
+	m.mu.Unlock()
+	if !exists {
+		return "", &NotFoundError{Task: task, Reason: "has not been started"}
+	}
+	if stream == Stderr {
+		return logger.ErrFileName(), nil
+	}
+	return logger.FileName(), nil
+}
+
+// KnownTasks returns the names of all tasks that have been started, whether
+// they are still running or not.
+func (m *Manager) KnownTasks() (tasks []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for task := range m.loggers {
+		tasks = append(tasks, task)
+	}
+	sort.Strings(tasks)
+	return tasks
+}
+
+// LogQuery selects the log lines of ReadLogs and FollowLogs.
+type LogQuery struct {
+	Tasks []string
+	// Tail is the number of lines to read from the end of each log.
+	Tail int
+	// Stream, if not empty, selects the lines of that stream only.
+	Stream string
+	// Raw keeps every line as written in LogLine.Raw.
+	Raw bool
+}
+
+// match parses s, a line of the log of task, and reports whether it is
+// selected by q.
+func (q LogQuery) match(task, s string) (LogLine, bool) {
+	line := ParseLogLine(s)
+	line.Task = task
+	if q.Raw {
+		line.Raw = s
+	}
+	return line, q.Stream == "" || line.Stream == q.Stream
+}
+
+// ReadLogs reads the last lines of the logs of the tasks selected by q and
+// interleaves them in time order.
+func (m *Manager) ReadLogs(q LogQuery) ([]LogLine, error) {
+	lists := make([][]LogLine, 0, len(q.Tasks))
+	for _, task := range q.Tasks {
+		filename, err := m.logFileName(task, q.Stream)
+		if err != nil {
+			return nil, err
+		}
+		lines, _, err := readTail(filename, task, q)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, lines)
+	}
+	return mergeLogLines(lists...), nil
+}
+
+// FollowLogs passes the last lines of the logs selected by q to send,
+// followed by every line written afterwards, until ctx ends. The files are
+// followed by name, so rotations and restarts of the tasks do not end it.
+func (m *Manager) FollowLogs(ctx context.Context, q LogQuery, send func(LogLine) error) error {
+	filenames := make([]string, len(q.Tasks))
+	offsets := make([]int64, len(q.Tasks))
+	lists := make([][]LogLine, 0, len(q.Tasks))
+	for i, task := range q.Tasks {
+		filename, err := m.logFileName(task, q.Stream)
+		if err != nil {
+			return err
+		}
+		lines, offset, err := readTail(filename, task, q)
+		if err != nil {
+			return err
+		}
+		filenames[i], offsets[i] = filename, offset
+		lists = append(lists, lines)
+	}
+	for _, line := range mergeLogLines(lists...) {
+		if err := send(line); err != nil {
+			return err
+		}
+	}
+
+	// new lines are passed in the order they arrive
+	var mu sync.Mutex
+	errc := make(chan error, len(q.Tasks))
+	for i, task := range q.Tasks {
+		go func(task, filename string, offset int64) {
+			errc <- followFile(filename, offset, ctx.Done(), func(s string) error {
+				line, ok := q.match(task, s)
+				if !ok {
+					return nil
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				return send(line)
+			})
+		}(task, filenames[i], offsets[i])
+	}
+	var err error
+	for range q.Tasks {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// followFile passes every line of filename from offset on to send, until
+// done is closed or send fails. It keeps following when the file is rotated.
+func followFile(filename string, offset int64, done <-chan struct{}, send func(string) error) error {
+	t, err := tail.TailFile(filename, tail.Config{
+		Location: &tail.SeekInfo{Offset: offset, Whence: io.SeekStart},
+		Follow:   true,
+		ReOpen:   true,
+		Logger:   tail.DiscardingLogger,
+	})
+	if err != nil {
+		return err
+	}
+	defer t.Cleanup()
+
+	for {
+		select {
+		case <-done:
+			return t.Stop()
+		case line, ok := <-t.Lines:
+			if !ok {
+				return t.Err()
+			}
+			if line.Err != nil {
+				continue
+			}
+			if err := send(line.Text); err != nil {
+				_ = t.Stop()
+				return err
+			}
+		}
+	}
+}
+
+// snapshot returns the persisted form of all managed tasks.
+func (m *Manager) snapshot() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var s State
+	for _, p := range m.procs {
+		p.mu.Lock()
+		if !finalState(p.state) {
+			ts := TaskState{Task: p.task}
+			if p.run != nil {
+				ts.Pid = p.run.pid
+				ts.StartTime = p.run.startTime
+			}
+			s.Tasks = append(s.Tasks, ts)
+		}
+		p.mu.Unlock()
+	}
+	return s
+}
+
+func (m *Manager) saveState() {
+	if m.StateFile == "" {
 		return
 	}
-	for line := range t.Lines {
-		lines = append(lines, line.Text)
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if err := WriteState(m.StateFile, m.snapshot()); err != nil {
+		m.logf("save state: %s", err)
+	}
+}
+
+// Restore loads StateFile written by a previous daemon. Processes that are
+// still running are re-adopted, the other tasks are started again.
+func (m *Manager) Restore(ctx context.Context) error {
+	if m.StateFile == "" {
+		return nil
+	}
+	s, err := ReadState(m.StateFile)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, ts := range s.Tasks {
+		if m.adopt(ts) {
+			continue
+		}
+		if err := m.Start(ctx, ts.Task); err != nil {
+			m.logf("start task `%s`: %s", ts.Task.Name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	m.saveState()
+	return first
+}
+
+// errAdoptedExit is the result of a re-adopted process, which isn't a child
+// of the daemon, so its exit status is unknown.
+var errAdoptedExit = errors.New("re-adopted process ended, its exit status is unknown")
+
+// adopt takes over a task process left behind by a previous daemon. The pid
+// must still belong to the same process, checked by its start time, and its
+// output FIFOs must still be there. A process whose output can't be read
+// anymore is killed, so that the task is started again.
+func (m *Manager) adopt(ts TaskState) bool {
+	if ts.Pid <= 0 || ts.StartTime == 0 {
+		return false
+	}
+	if !processAlive(ts.Pid, ts.StartTime) {
+		return false
+	}
+	process, err := os.FindProcess(ts.Pid)
+	if err != nil {
+		return false
+	}
+
+	task := ts.Task
+	stdout, err := openFIFO(m.outputFIFO(task.Name, Stdout))
+	if err != nil {
+		m.abandon(task, process, ts.StartTime, err)
+		return false
+	}
+	stderr, err := openFIFO(m.outputFIFO(task.Name, Stderr))
+	if err != nil {
+		stdout.Close()
+		m.abandon(task, process, ts.StartTime, err)
+		return false
+	}
+	p, err := m.newProc(task)
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return true
+	}
+	logging, err := m.newLogger(task)
+	if err != nil {
+		// the process is still running, it must not be started twice
+		m.logf("adopt task `%s`: %s", task.Name, err)
+		stdout.Close()
+		stderr.Close()
+		p.finish(StateFailed, err)
+		close(p.done)
+		return true
+	}
+	logging.SetPid(ts.Pid)
+	r := &procRun{
+		process:   process,
+		pid:       ts.Pid,
+		startTime: ts.StartTime,
+		logger:    logging,
+		wait:      make(chan error, 1),
+		ended:     make(chan struct{}),
+	}
+	if boot, err := bootTime(); err == nil {
+		r.started = procStat{StartTime: ts.StartTime}.startedAt(boot)
+	}
+	m.readOutput(task, r, stdout, stderr)
+
+	m.logf("task `%s` re-adopted with pid %d", task.Name, ts.Pid)
+	go m.watch(r)
+	go p.supervise(context.Background(), r, nil)
+	return true
+}
+
+// abandon kills the process group of a task that can't be re-adopted and
+// waits for it to end, the task is started again afterwards.
+func (m *Manager) abandon(task Task, process *os.Process, startTime uint64, err error) {
+	m.logf("output of task `%s` with pid %d is lost, killing it: %s", task.Name, process.Pid, err)
+	if err := killGroup(process); err != nil {
+		m.logf("kill task `%s`: %s", task.Name, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if !processAlive(process.Pid, startTime) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// watch waits for the end of a re-adopted process. It is not a child of
+// this daemon, so it is polled instead of waited for.
+func (m *Manager) watch(r *procRun) {
+	for processAlive(r.pid, r.startTime) {
+		time.Sleep(time.Second)
+	}
+	r.wait <- errAdoptedExit
+}
+
+// processAlive reports whether pid still is the process started at
+// startTime.
+func processAlive(pid int, startTime uint64) bool {
+	st, err := processStartTime(pid)
+	return err == nil && st == startTime
+}
+
+// Save writes the currently running tasks to filename.
+func (m *Manager) Save(filename string) error {
+	return WriteState(filename, m.snapshot())
+}
+
+// Resurrect starts the tasks saved in filename that are not running.
+func (m *Manager) Resurrect(ctx context.Context, filename string) error {
+	s, err := ReadState(filename)
+	if err != nil {
+		return err
+	}
+	running := make(map[string]bool)
+	for _, name := range m.List() {
+		running[name] = true
+	}
+	tasks := make([]Task, 0, len(s.Tasks))
+	for _, ts := range s.Tasks {
+		if !running[ts.Task.Name] {
+			tasks = append(tasks, ts.Task)
+		}
 	}
-	return lines
+	return m.StartAll(ctx, tasks)
 }
@@ -0,0 +1,408 @@
+package spm
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testManager(t *testing.T) (*Manager, *bytes.Buffer, func()) {
+	dir, err := ioutil.TempDir("", "spm-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager()
+	m.LogDir = dir
+	m.StopTimeout = time.Second
+	var buf bytes.Buffer
+	m.Log = log.New(&buf, "", 0)
+	return m, &buf, func() {
+		m.StopAll(context.Background())
+		os.RemoveAll(dir)
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan Event, typ string) Event {
+	select {
+	case e := <-events:
+		if e.Type != typ {
+			t.Fatalf("got event %s of %s, want %s", e.Type, e.Task, typ)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event", typ)
+	}
+	return Event{}
+}
+
+func TestManagerEvents(t *testing.T) {
+	m, logs, cleanup := testManager(t)
+	defer cleanup()
+	events, unsubscribe := m.Subscribe(10)
+	defer unsubscribe()
+	ctx := context.Background()
+
+	sleeper := Task{Name: "sleeper", Command: []string{"sleep", "30"}, Ready: []string{"true"}}
+	if err := m.Start(ctx, sleeper); err != nil {
+		t.Fatal(err)
+	}
+	started := nextEvent(t, events, EventStarted)
+	if started.Task != "sleeper" || started.Pid == 0 {
+		t.Errorf("bad started event %+v", started)
+	}
+	nextEvent(t, events, EventReady)
+
+	if err := m.Start(ctx, sleeper); err == nil {
+		t.Error("started a running task twice")
+	}
+	if err := m.Start(ctx, Task{Name: "empty"}); err == nil {
+		t.Error("started a task without command")
+	}
+
+	if err := m.Restart(ctx, "sleeper"); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, events, EventExited); e.ExitCode != 128+15 {
+		t.Errorf("stopped task exited with %d", e.ExitCode)
+	}
+	nextEvent(t, events, EventStopped)
+	nextEvent(t, events, EventStarted)
+	// ready and restarted race each other
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			seen[e.Type] = true
+		case <-time.After(5 * time.Second):
+		}
+	}
+	if !seen[EventReady] || !seen[EventRestarted] {
+		t.Errorf("got events %v after restart, want ready and restarted", seen)
+	}
+
+	if err := m.Stop(WithClient(ctx, "alice"), "sleeper"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, events, EventExited)
+	if e := nextEvent(t, events, EventStopped); e.By != "alice" {
+		t.Errorf("task stopped by %q, want alice", e.By)
+	}
+	if err := m.Stop(ctx, "sleeper"); err == nil {
+		t.Error("stopped a task that is not running")
+	}
+
+	sick := Task{Name: "sick", Command: []string{"sleep", "30"}, Ready: []string{"false"}}
+	if err := m.Start(ctx, sick); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, events, EventStarted)
+	if e := nextEvent(t, events, EventUnhealthy); e.Error == "" {
+		t.Errorf("unhealthy event without error %+v", e)
+	}
+	if !strings.Contains(logs.String(), "task `sleeper` has been started") {
+		t.Errorf("manager did not log to its logger: %q", logs.String())
+	}
+}
+
+func TestManagerStartNeedFails(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+
+	err := m.Start(context.Background(), Task{
+		Name:    "web",
+		Command: []string{"sleep", "30"},
+		Need:    [][]string{{"false"}},
+	})
+	if err == nil {
+		t.Fatal("need command failure not returned")
+	}
+	if len(m.List()) != 0 {
+		t.Error("task runs although its need command failed")
+	}
+
+	// the need command is killed with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = m.Start(ctx, Task{
+		Name:    "web",
+		Command: []string{"sleep", "30"},
+		Need:    [][]string{{"sleep", "30"}},
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+}
+
+func waitState(t *testing.T, m *Manager, name, state string) TaskStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses, err := m.Status(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statuses[0].State == state {
+			return statuses[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s is %s, want %s", name, statuses[0].State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestManagerRestartPolicy(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	m.Backoff = 10 * time.Millisecond
+	ctx := context.Background()
+
+	crasher := Task{Name: "crasher", Command: []string{"false"}, Restart: RestartOnFailure, MaxRestarts: 2}
+	if err := m.Start(ctx, crasher); err != nil {
+		t.Fatal(err)
+	}
+	s := waitState(t, m, "crasher", StateFailed)
+	if s.Restarts != 2 || s.ExitCode != 1 || s.Error == "" {
+		t.Errorf("bad status of failed task %+v", s)
+	}
+	if len(m.List()) != 0 {
+		t.Errorf("failed task is listed")
+	}
+
+	done := Task{Name: "done", Command: []string{"true"}, Restart: RestartOnFailure}
+	if err := m.Start(ctx, done); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitState(t, m, "done", StateExited); s.Restarts != 0 {
+		t.Errorf("successful task was restarted %d times", s.Restarts)
+	}
+
+	// a task waiting for its restart is stopped right away
+	m.Backoff = time.Hour
+	m.MaxBackoff = time.Hour
+	looper := Task{Name: "looper", Command: []string{"true"}, Restart: RestartAlways}
+	if err := m.Start(ctx, looper); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, m, "looper", StateBackoff)
+	if err := m.Stop(ctx, "looper"); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, m, "looper", StateStopped)
+
+	// tasks in a final state can be started again
+	if err := m.Start(ctx, looper); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerConcurrentStop(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	events, unsubscribe := m.Subscribe(10)
+	defer unsubscribe()
+	// ignores SIGTERM once ready, so it is stopping until StopTimeout kills it
+	trapped := filepath.Join(m.LogDir, "trapped")
+	stubborn := Task{
+		Name:    "stubborn",
+		Command: []string{"sh", "-c", "trap '' TERM; touch " + trapped + "; sleep 30 & wait"},
+		Ready:   []string{"test", "-f", trapped},
+	}
+	if err := m.Start(ctx, stubborn); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, events, EventStarted)
+	// the first check may come before the trap
+	select {
+	case e := <-events:
+		if e.Type == EventUnhealthy {
+			nextEvent(t, events, EventReady)
+		} else if e.Type != EventReady {
+			t.Fatalf("got event %s, want ready", e.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ready event")
+	}
+	errc := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			errc <- m.Stop(ctx, "stubborn")
+		}()
+	}
+	waitState(t, m, "stubborn", StateStopping)
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stop blocked")
+		}
+	}
+	waitState(t, m, "stubborn", StateStopped)
+
+	// a stop cancels the need commands of a starting task
+	slow := Task{Name: "slow", Command: []string{"sleep", "30"}, Need: [][]string{{"sleep", "30"}}}
+	go func() {
+		errc <- m.Start(ctx, slow)
+	}()
+	for len(m.List()) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitState(t, m, "slow", StateStarting)
+	if err := m.Stop(ctx, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil {
+		t.Error("stopped start did not fail")
+	}
+	waitState(t, m, "slow", StateStopped)
+}
+
+func TestManagerRace(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	m.Backoff = time.Millisecond
+	ctx := context.Background()
+
+	task := Task{Name: "flaky", Command: []string{"sleep", "0.01"}, Restart: RestartAlways}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				m.Start(ctx, task)
+				m.Status()
+				m.List()
+				m.Stop(ctx, "flaky")
+			}
+		}()
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	m.Stop(ctx, "flaky")
+	if s, err := m.Status("flaky"); err != nil || !finalState(s[0].State) {
+		t.Errorf("task is %+v after stop, %v", s, err)
+	}
+}
+
+func TestManagerExitCodes(t *testing.T) {
+	m, logs, cleanup := testManager(t)
+	defer cleanup()
+	m.CriticalExit = make(chan int, 1)
+	m.StopTimeout = 100 * time.Millisecond
+	ctx := context.Background()
+
+	// killed tasks exit with 128 plus the signal like in a shell
+	killed := Task{Name: "killed", Command: []string{"sh", "-c", "kill -9 $$"}}
+	if err := m.Start(ctx, killed); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitState(t, m, "killed", StateExited); s.ExitCode != 128+9 {
+		t.Errorf("killed task exited with %d, want %d", s.ExitCode, 128+9)
+	}
+
+	// a task that ignores the stop signal is killed after StopTimeout
+	trapped := filepath.Join(m.LogDir, "trapped")
+	stubborn := Task{Name: "stubborn", Command: []string{"sh", "-c", "trap '' TERM; touch " + trapped + "; while :; do sleep 1; done"}}
+	if err := m.Start(ctx, stubborn); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, err := os.Stat(trapped); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	begin := time.Now()
+	if err := m.Stop(ctx, "stubborn"); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(begin); took < m.StopTimeout || took > 5*time.Second {
+		t.Errorf("stubborn task stopped after %s, want it killed after %s", took, m.StopTimeout)
+	}
+	if s := waitState(t, m, "stubborn", StateStopped); s.ExitCode != 128+9 {
+		t.Errorf("stubborn task exited with %d, want %d", s.ExitCode, 128+9)
+	}
+	if !strings.Contains(logs.String(), "task `stubborn` did not stop in 100ms, killing it") {
+		t.Errorf("kill of stubborn task is not logged: %q", logs.String())
+	}
+
+	// stopping a critical task is no reason to exit
+	critical := Task{Name: "critical", Command: []string{"sleep", "30"}, Critical: true}
+	if err := m.Start(ctx, critical); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Stop(ctx, "critical"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-m.CriticalExit:
+		t.Errorf("stopped critical task exits the daemon with %d", code)
+	default:
+	}
+	// ending on its own is
+	critical.Command = []string{"sh", "-c", "exit 3"}
+	if err := m.Start(ctx, critical); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-m.CriticalExit:
+		if code != 3 {
+			t.Errorf("critical task exits the daemon with %d, want 3", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("ended critical task does not exit the daemon")
+	}
+}
+
+func TestManagerShutdown(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	events, unsubscribe := m.Subscribe(30)
+	defer unsubscribe()
+	ctx := context.Background()
+
+	names := []string{"db", "web", "worker"}
+	for _, name := range names {
+		if err := m.Start(ctx, Task{Name: name, Command: []string{"sleep", "30"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Shutdown(ctx, os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	var stopped []string
+	for len(stopped) < len(names) {
+		select {
+		case e := <-events:
+			if e.Type == EventStopped {
+				stopped = append(stopped, e.Task)
+				if e.By != "shutdown" {
+					t.Errorf("task %s stopped by %q, want shutdown", e.Task, e.By)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got stopped events of %v, want all tasks", stopped)
+		}
+	}
+	if want := []string{"worker", "web", "db"}; strings.Join(stopped, " ") != strings.Join(want, " ") {
+		t.Errorf("tasks stopped in order %v, want %v", stopped, want)
+	}
+}
@@ -11,6 +11,28 @@ import (
 	"syscall"
 )
 
+// exitCode maps the result of waiting for a task to a shell style exit code,
+// 128+n for a task killed by signal n.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				return 128 + int(ws.Signal())
+			}
+			return ws.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// killGroup kills the process group p leads, tasks run in their own group.
+func killGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
 func setupUserAndGroup(c *exec.Cmd, task Task) error {
 	c.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid:true,
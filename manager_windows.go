@@ -2,8 +2,25 @@
 
 package spm
 
-import "os/exec"
+import (
+	"os"
+	"os/exec"
+)
 
-func setupUserAndGroup(c *exec.Cmd,task Task) error {
+func setupUserAndGroup(c *exec.Cmd, task Task) error {
 	return nil
 }
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		return e.ExitCode()
+	}
+	return 1
+}
+
+func killGroup(p *os.Process) error {
+	return p.Kill()
+}
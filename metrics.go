@@ -0,0 +1,244 @@
+package spm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of request latencies in
+// seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// RequestMetrics counts the requests served on a Listener by method and
+// result, and measures how long they took. Streams like followed logs count
+// once they end. The zero value is ready to use.
+type RequestMetrics struct {
+	mu        sync.Mutex
+	counts    map[requestKey]uint64
+	latencies map[string]*histogram
+}
+
+type requestKey struct {
+	method string
+	code   string // error code, "ok" for success
+}
+
+type histogram struct {
+	buckets []uint64 // observations per bucket of latencyBuckets, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// knownMethods are the methods of the protocol. Other methods are counted as
+// "unknown", clients can't add series to the metrics.
+var knownMethods = map[string]bool{
+	MethodStart: true, MethodStop: true, MethodRestart: true, MethodStatus: true,
+	MethodList: true, MethodSave: true, MethodResurrect: true, MethodRotate: true,
+	MethodScale: true, MethodPs: true, MethodLog: true, MethodGrep: true,
+	MethodEvents: true, MethodCancel: true,
+}
+
+// Observe records a request of method that ended with the error code code,
+// empty for success, after d.
+func (rm *RequestMetrics) Observe(method, code string, d time.Duration) {
+	if !knownMethods[method] {
+		method = "unknown"
+	}
+	if code == "" {
+		code = "ok"
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.counts == nil {
+		rm.counts = make(map[requestKey]uint64)
+		rm.latencies = make(map[string]*histogram)
+	}
+	rm.counts[requestKey{method, code}]++
+	h := rm.latencies[method]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		rm.latencies[method] = h
+	}
+	seconds := d.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// write writes the requests in the Prometheus text format.
+func (rm *RequestMetrics) write(w io.Writer) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP spm_requests_total Requests served on the sockets of the daemon by method and error code.")
+	fmt.Fprintln(w, "# TYPE spm_requests_total counter")
+	keys := make([]requestKey, 0, len(rm.counts))
+	for key := range rm.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "spm_requests_total{method=%s,code=%s} %d\n", quoteLabel(key.method), quoteLabel(key.code), rm.counts[key])
+	}
+
+	fmt.Fprintln(w, "# HELP spm_request_duration_seconds Time taken to serve requests on the sockets of the daemon.")
+	fmt.Fprintln(w, "# TYPE spm_request_duration_seconds histogram")
+	methods := make([]string, 0, len(rm.latencies))
+	for method := range rm.latencies {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		h := rm.latencies[method]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "spm_request_duration_seconds_bucket{method=%s,le=\"%g\"} %d\n", quoteLabel(method), le, cumulative)
+		}
+		fmt.Fprintf(w, "spm_request_duration_seconds_bucket{method=%s,le=\"+Inf\"} %d\n", quoteLabel(method), h.count)
+		fmt.Fprintf(w, "spm_request_duration_seconds_sum{method=%s} %g\n", quoteLabel(method), h.sum)
+		fmt.Fprintf(w, "spm_request_duration_seconds_count{method=%s} %d\n", quoteLabel(method), h.count)
+	}
+}
+
+// taskMetrics are the metrics of a task.
+type taskMetrics struct {
+	TaskStatus
+	usage    usage
+	logLines uint64
+	logBytes uint64
+}
+
+// states are all states of tasks, in the order of their metrics.
+var states = []string{StateStarting, StateRunning, StateStopping, StateBackoff, StateStopped, StateExited, StateFailed}
+
+// WriteMetrics writes the metrics of the started tasks and of the requests
+// in m.Requests in the Prometheus text format.
+func (m *Manager) WriteMetrics(w io.Writer) error {
+	m.mu.Lock()
+	procs := make([]*proc, 0, len(m.procs))
+	for _, p := range m.procs {
+		procs = append(procs, p)
+	}
+	m.mu.Unlock()
+	sort.Slice(procs, func(i, j int) bool { return procs[i].task.Name < procs[j].task.Name })
+
+	usages := procUsages(procs)
+	tasks := make([]taskMetrics, len(procs))
+	for i, p := range procs {
+		t := taskMetrics{TaskStatus: p.status(usages)}
+		if !finalState(t.State) {
+			t.usage = usages[t.Pid]
+		}
+		p.mu.Lock()
+		if p.run != nil {
+			t.logLines, t.logBytes = p.run.logger.Written()
+		}
+		p.mu.Unlock()
+		tasks[i] = t
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP spm_build_info Version of the daemon.")
+	fmt.Fprintln(bw, "# TYPE spm_build_info gauge")
+	fmt.Fprintf(bw, "spm_build_info{version=%s} 1\n", quoteLabel(Version))
+
+	// metric writes the metric name of type typ with a value for every task
+	metric := func(name, typ, help string, value func(t taskMetrics) float64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, t := range tasks {
+			fmt.Fprintf(bw, "%s{task=%s} %g\n", name, quoteLabel(t.Name), value(t))
+		}
+	}
+
+	metric("spm_task_up", "gauge", "Whether the task is running.", func(t taskMetrics) float64 {
+		if t.State == StateRunning {
+			return 1
+		}
+		return 0
+	})
+	fmt.Fprintln(bw, "# HELP spm_task_state State of the task, 1 for the current one.")
+	fmt.Fprintln(bw, "# TYPE spm_task_state gauge")
+	for _, t := range tasks {
+		for _, state := range states {
+			value := 0
+			if t.State == state {
+				value = 1
+			}
+			fmt.Fprintf(bw, "spm_task_state{task=%s,state=%s} %d\n", quoteLabel(t.Name), quoteLabel(state), value)
+		}
+	}
+	metric("spm_task_restarts_total", "counter", "Restarts of the task by its restart policy.", func(t taskMetrics) float64 {
+		return float64(t.Restarts)
+	})
+	metric("spm_task_exit_code", "gauge", "Exit code of the last run of the task.", func(t taskMetrics) float64 {
+		return float64(t.ExitCode)
+	})
+	metric("spm_task_uptime_seconds", "gauge", "Time since the running task was started.", func(t taskMetrics) float64 {
+		if finalState(t.State) || t.Pid == 0 {
+			return 0
+		}
+		return time.Since(t.Started).Seconds()
+	})
+	// the CPU time of processes that ended leaves the sum, so it is no
+	// counter
+	metric("spm_task_cpu_seconds", "gauge", "CPU time of the live processes in the process group of the running task.", func(t taskMetrics) float64 {
+		return t.usage.CPU.Seconds()
+	})
+	metric("spm_task_resident_memory_bytes", "gauge", "Resident memory of the process group of the running task.", func(t taskMetrics) float64 {
+		return float64(t.usage.RSS)
+	})
+	metric("spm_task_open_fds", "gauge", "Open file descriptors of the process group of the running task.", func(t taskMetrics) float64 {
+		return float64(t.usage.FDs)
+	})
+	metric("spm_task_processes", "gauge", "Processes in the process group of the running task.", func(t taskMetrics) float64 {
+		return float64(t.usage.Procs)
+	})
+	metric("spm_log_lines_total", "counter", "Lines of the current run of the task written to its log files.", func(t taskMetrics) float64 {
+		return float64(t.logLines)
+	})
+	metric("spm_log_bytes_total", "counter", "Bytes of the current run of the task written to its log files.", func(t taskMetrics) float64 {
+		return float64(t.logBytes)
+	})
+	metric("spm_log_dropped_lines_total", "counter", "Lines of the current run of the task that didn't make it into its log.", func(t taskMetrics) float64 {
+		return float64(t.LogDropped)
+	})
+
+	m.Requests.write(bw)
+	return bw.Flush()
+}
+
+// NewMetricsHandler returns the handler that serves the metrics of m in the
+// Prometheus text format.
+func NewMetricsHandler(m *Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = m.WriteMetrics(w)
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes the label value s.
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,61 @@
+package spm
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	task := Task{Name: `web"1`, Command: []string{"sh", "-c", "echo hello; sleep 30"}}
+	if err := m.Start(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	m.Requests.Observe(MethodList, "", 3*time.Millisecond)
+	m.Requests.Observe(MethodStop, CodeNotFound, 20*time.Millisecond)
+	m.Requests.Observe("nope", CodeUnknownMethod, time.Millisecond)
+	m.Requests.Observe("nope2", CodeUnknownMethod, time.Millisecond)
+
+	var buf bytes.Buffer
+	want := []string{
+		`spm_task_up{task="web\"1"} 1`,
+		`spm_task_state{task="web\"1",state="running"} 1`,
+		`spm_task_state{task="web\"1",state="failed"} 0`,
+		`spm_task_restarts_total{task="web\"1"} 0`,
+		`spm_log_lines_total{task="web\"1"} 1`,
+		`spm_requests_total{method="list",code="ok"} 1`,
+		`spm_requests_total{method="stop",code="not_found"} 1`,
+		`spm_requests_total{method="unknown",code="unknown_method"} 2`,
+		`spm_request_duration_seconds_bucket{method="list",le="0.001"} 0`,
+		`spm_request_duration_seconds_bucket{method="list",le="0.005"} 1`,
+		`spm_request_duration_seconds_bucket{method="stop",le="+Inf"} 1`,
+	}
+	// the line reaches the log file in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf.Reset()
+		if err := m.WriteMetrics(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), want[4]) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range want {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("no %s in metrics:\n%s", line, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "spm_task_cpu_seconds_total") || !strings.Contains(buf.String(), "# TYPE spm_task_cpu_seconds gauge\n") {
+		t.Error("CPU time of the live processes is not a gauge")
+	}
+	if runtime.GOOS == "linux" && strings.Contains(buf.String(), `spm_task_processes{task="web\"1"} 0`) {
+		t.Error("no processes of the running task")
+	}
+}
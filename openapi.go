@@ -0,0 +1,295 @@
+package spm
+
+// openAPI describes the REST API served by NewHTTPHandler, it is served at
+// /v1/openapi.json.
+const openAPI = `{
+  "openapi": "3.0.2",
+  "info": {
+    "title": "spm",
+    "description": "REST API of the spm daemon, with the semantics of the requests on its unix socket. Reading is open, requests that change tasks need the bearer token of the daemon.",
+    "version": "` + Version + `"
+  },
+  "paths": {
+    "/v1/tasks": {
+      "get": {
+        "summary": "Status of all started tasks",
+        "responses": {
+          "200": {"description": "Tasks", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StatusResult"}}}}
+        }
+      },
+      "post": {
+        "summary": "Start tasks of a Procfile or given tasks",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/StartParams"}}}},
+        "responses": {
+          "204": {"description": "Started"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "get": {
+        "summary": "Status of a task",
+        "responses": {
+          "200": {"$ref": "#/components/responses/TaskStatus"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}/start": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "summary": "Start a task that ended again, reloaded from its Procfile",
+        "responses": {
+          "200": {"$ref": "#/components/responses/TaskStatus"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}/stop": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "summary": "Stop a task and wait for it to end",
+        "responses": {
+          "200": {"$ref": "#/components/responses/TaskStatus"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}/restart": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "summary": "Stop a task and start it again, reloaded from its Procfile",
+        "responses": {
+          "200": {"$ref": "#/components/responses/TaskStatus"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}/scale": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "summary": "Run a number of instances of a task, named name.2, name.3 and so on",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ScaleParams"}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/TaskStatus"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}/rotate": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "summary": "Rotate the log file of a running task",
+        "responses": {
+          "200": {"$ref": "#/components/responses/TaskStatus"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}/logs": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "get": {
+        "summary": "Log lines of a task, like /v1/logs",
+        "parameters": [
+          {"$ref": "#/components/parameters/tail"},
+          {"$ref": "#/components/parameters/stream"},
+          {"$ref": "#/components/parameters/raw"},
+          {"$ref": "#/components/parameters/follow"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Logs"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/tasks/{name}/grep": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "get": {
+        "summary": "Log lines of a task matching a pattern, streamed as JSON lines",
+        "parameters": [
+          {"name": "pattern", "in": "query", "required": true, "schema": {"type": "string"}, "description": "Regular expression"},
+          {"name": "since", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "until", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "context", "in": "query", "schema": {"type": "integer"}, "description": "Lines around each match"},
+          {"$ref": "#/components/parameters/stream"}
+        ],
+        "responses": {
+          "200": {"description": "Lines", "content": {"application/x-ndjson": {"schema": {"$ref": "#/components/schemas/LogLine"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/logs": {
+      "get": {
+        "summary": "Last log lines of tasks in time order, followed as chunked JSON lines with follow",
+        "parameters": [
+          {"name": "task", "in": "query", "schema": {"type": "array", "items": {"type": "string"}}, "explode": true, "description": "Tasks, all known tasks if none"},
+          {"$ref": "#/components/parameters/tail"},
+          {"$ref": "#/components/parameters/stream"},
+          {"$ref": "#/components/parameters/raw"},
+          {"$ref": "#/components/parameters/follow"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Logs"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/events": {
+      "get": {
+        "summary": "Events of tasks as server-sent events, named by their type",
+        "parameters": [
+          {"name": "task", "in": "query", "schema": {"type": "array", "items": {"type": "string"}}, "explode": true},
+          {"name": "type", "in": "query", "schema": {"type": "array", "items": {"$ref": "#/components/schemas/EventType"}}, "explode": true}
+        ],
+        "responses": {
+          "200": {"description": "Events, the data of each is an Event", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/Event"}}}}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Metrics of tasks and requests in the Prometheus text format",
+        "responses": {
+          "200": {"description": "Metrics", "content": {"text/plain": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/v1/auth": {
+      "get": {
+        "summary": "What the client may do with the token it presents",
+        "responses": {
+          "200": {"description": "Permissions", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuthResult"}}}}
+        }
+      }
+    },
+    "/v1/save": {
+      "post": {
+        "summary": "Save the running tasks to a dump file",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/SaveParams"}}}},
+        "responses": {
+          "204": {"description": "Saved"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/resurrect": {
+      "post": {
+        "summary": "Start the tasks of a dump file that are not running",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/SaveParams"}}}},
+        "responses": {
+          "204": {"description": "Started"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "security": [{}, {"token": []}],
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+      "tail": {"name": "tail", "in": "query", "schema": {"type": "integer", "default": 200}},
+      "stream": {"name": "stream", "in": "query", "schema": {"type": "string", "enum": ["stdout", "stderr"]}},
+      "raw": {"name": "raw", "in": "query", "schema": {"type": "boolean"}, "description": "Keep lines as written in Raw"},
+      "follow": {"name": "follow", "in": "query", "schema": {"type": "boolean"}, "description": "Stream new lines as JSON lines"}
+    },
+    "responses": {
+      "TaskStatus": {"description": "Status of the task", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TaskStatus"}}}},
+      "Logs": {
+        "description": "A LogResult, or a chunked stream of LogLine objects when followed",
+        "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/LogResult"}},
+          "application/x-ndjson": {"schema": {"$ref": "#/components/schemas/LogLine"}}
+        }
+      },
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "Code": {"type": "string", "enum": ["bad_request", "unknown_method", "not_found", "forbidden", "failed"]},
+          "Message": {"type": "string"}
+        }
+      },
+      "TaskStatus": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "State": {"type": "string", "enum": ["starting", "running", "stopping", "backoff", "stopped", "exited", "failed"]},
+          "Pid": {"type": "integer"},
+          "Started": {"type": "string", "format": "date-time"},
+          "Command": {"type": "array", "items": {"type": "string"}},
+          "Procfile": {"type": "string"},
+          "Restarts": {"type": "integer"},
+          "ExitCode": {"type": "integer"},
+          "Error": {"type": "string"},
+          "LogFile": {"type": "string"},
+          "LogDropped": {"type": "integer"},
+          "CPU": {"type": "number", "description": "Percent of one core used by a running task"},
+          "Memory": {"type": "integer", "description": "Resident memory of a running task in bytes"}
+        }
+      },
+      "AuthResult": {
+        "type": "object",
+        "properties": {"Write": {"type": "boolean", "description": "The client may change tasks"}}
+      },
+      "StatusResult": {
+        "type": "object",
+        "properties": {"Tasks": {"type": "array", "items": {"$ref": "#/components/schemas/TaskStatus"}}}
+      },
+      "StartParams": {
+        "type": "object",
+        "properties": {
+          "Procfile": {"type": "string", "description": "Absolute path of a Procfile"},
+          "Tasks": {"type": "array", "items": {"type": "string"}, "description": "Tasks of the Procfile, all if empty"},
+          "Jobs": {"type": "array", "items": {"type": "object"}, "description": "Tasks to start as they are"}
+        }
+      },
+      "ScaleParams": {
+        "type": "object",
+        "properties": {"Count": {"type": "integer", "minimum": 0}}
+      },
+      "SaveParams": {
+        "type": "object",
+        "properties": {"File": {"type": "string", "description": "Dump file, ~/.spm/dump.json if empty"}}
+      },
+      "LogLine": {
+        "type": "object",
+        "properties": {
+          "Time": {"type": "string", "format": "date-time"},
+          "Task": {"type": "string"},
+          "Stream": {"type": "string"},
+          "Text": {"type": "string"},
+          "Raw": {"type": "string"},
+          "Context": {"type": "boolean", "description": "Line around a match of a search"}
+        }
+      },
+      "LogResult": {
+        "type": "object",
+        "properties": {
+          "Tasks": {"type": "array", "items": {"type": "string"}},
+          "Lines": {"type": "array", "items": {"$ref": "#/components/schemas/LogLine"}}
+        }
+      },
+      "Event": {
+        "type": "object",
+        "properties": {
+          "Type": {"$ref": "#/components/schemas/EventType"},
+          "Task": {"type": "string"},
+          "Time": {"type": "string", "format": "date-time"},
+          "Pid": {"type": "integer"},
+          "ExitCode": {"type": "integer"},
+          "By": {"type": "string", "description": "Client that stopped the task"},
+          "Error": {"type": "string", "description": "Why the task is unhealthy"}
+        }
+      },
+      "EventType": {"type": "string", "enum": ["started", "ready", "unhealthy", "exited", "restarted", "stopped", "reloaded"]}
+    }
+  }
+}
+`
@@ -7,8 +7,11 @@ import (
 	"github.com/mholt/caddy/caddyfile"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 type Parser struct {
@@ -21,6 +24,52 @@ func NewParser(r io.Reader) *Parser {
 	return &Parser{r: r}
 }
 
+// ParseFile parses the Procfile at filename. Relative task directories are
+// resolved against the directory of the Procfile and every task remembers
+// the file it came from.
+func ParseFile(filename string) ([]Task, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Parser{filename: filename, r: f}
+	return p.Parse()
+}
+
+// LoadTasks parses the Procfile at filename and returns the tasks listed in
+// names, or every task of the file when names is empty.
+func LoadTasks(filename string, names []string) ([]Task, error) {
+	tasks, err := ParseFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return tasks, nil
+	}
+
+	selected := make([]Task, 0, len(names))
+	for _, name := range names {
+		exist := false
+		for _, task := range tasks {
+			if task.Name == name {
+				selected = append(selected, task)
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			return nil, &NotFoundError{Task: name, Reason: "does not exist in " + filename}
+		}
+	}
+	return selected, nil
+}
+
 func (p *Parser) Parse() (jobs []Task, err error) {
 	p.cfg, err = ioutil.ReadAll(p.r)
 	if err != nil {
@@ -28,10 +77,23 @@ func (p *Parser) Parse() (jobs []Task, err error) {
 	}
 	d := caddyfile.NewDispenser(p.filename, bytes.NewBuffer(p.cfg))
 
-	return parseTasks(d)
+	jobs, err = parseTasks(&d)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		if jobs[i].Dir != "" && !filepath.IsAbs(jobs[i].Dir) {
+			if p.filename == "" {
+				return nil, fmt.Errorf("dir %s is not an absolute address", jobs[i].Dir)
+			}
+			jobs[i].Dir = filepath.Join(filepath.Dir(p.filename), jobs[i].Dir)
+		}
+		jobs[i].Procfile = p.filename
+	}
+	return jobs, nil
 }
 
-func parseTasks(d caddyfile.Dispenser) ([]Task, error) {
+func parseTasks(d *caddyfile.Dispenser) ([]Task, error) {
 	var task Task
 	tasks := make([]Task, 0, 10)
 	for d.Next() {
@@ -50,6 +112,9 @@ func parseTasks(d caddyfile.Dispenser) ([]Task, error) {
 					return nil, err
 				}
 			}
+			if err := checkLog(task); err != nil {
+				return nil, err
+			}
 			tasks = append(tasks, task)
 		default:
 			if err := updateTask(&task, d, val, args); err != nil {
@@ -58,13 +123,25 @@ func parseTasks(d caddyfile.Dispenser) ([]Task, error) {
 		}
 	}
 	if task.Valid() {
+		if err := checkLog(task); err != nil {
+			return nil, err
+		}
 		tasks = append(tasks, task)
 	}
 
 	return tasks, nil
 }
 
-func updateTask(task *Task, d caddyfile.Dispenser, key string, args []string) error {
+// checkLog rejects log directives of task that don't go together. Raw output
+// is copied as it comes, there are no lines to filter or forward to sinks.
+func checkLog(task Task) error {
+	if task.Log != nil && task.Log.Raw && (len(task.LogFilters) > 0 || len(task.LogSinks) > 0) {
+		return fmt.Errorf("task %s: raw logs can't have log_filter or log_sink", task.Name)
+	}
+	return nil
+}
+
+func updateTask(task *Task, d *caddyfile.Dispenser, key string, args []string) error {
 	switch key {
 	case "name":
 		if task.Name != "" {
@@ -119,9 +196,6 @@ func updateTask(task *Task, d caddyfile.Dispenser, key string, args []string) er
 		if len(args) != 1 {
 			return d.ArgErr()
 		}
-		if !filepath.IsAbs(args[0]) {
-			return fmt.Errorf("dir %s is not an absolute address", args[0])
-		}
 		task.Dir = args[0]
 	case "chroot":
 		if task.Chroot != "" {
@@ -142,8 +216,226 @@ func updateTask(task *Task, d caddyfile.Dispenser, key string, args []string) er
 			return d.ArgErr()
 		}
 		task.Need = append(task.Need, args)
+	case "ready":
+		if task.Ready != nil {
+			return fmt.Errorf("set ready two times")
+		}
+		if len(args) < 1 {
+			return d.ArgErr()
+		}
+		task.Ready = args
+	case "log":
+		if task.Log != nil {
+			return fmt.Errorf("set log two times")
+		}
+		cfg := DefaultLogConfig()
+		switch {
+		case len(args) == 0 && d.NextArg() && d.Val() == "{":
+			if err := parseLogBlock(&cfg, d); err != nil {
+				return err
+			}
+		case len(args) == 1:
+			cfg.Path = args[0]
+		default:
+			return d.ArgErr()
+		}
+		task.Log = &cfg
+	case "log_format":
+		if task.LogFormat != "" {
+			return fmt.Errorf("set log_format two times")
+		}
+		if len(args) != 1 {
+			return d.ArgErr()
+		}
+		if !ValidLogFormat(args[0]) {
+			return d.Errf("unknown log_format %s", args[0])
+		}
+		task.LogFormat = args[0]
+	case "log_output":
+		if task.LogOutput != "" {
+			return fmt.Errorf("set log_output two times")
+		}
+		if len(args) != 1 {
+			return d.ArgErr()
+		}
+		if !ValidLogOutput(args[0]) {
+			return d.Errf("unknown log_output %s", args[0])
+		}
+		task.LogOutput = args[0]
+	case "log_sink":
+		if len(args) < 1 {
+			return d.ArgErr()
+		}
+		cfg := SinkConfig{Type: args[0]}
+		switch {
+		case args[0] == SinkSyslog && (len(args) == 2 || len(args) == 3):
+			cfg.Address = args[1]
+			if len(args) == 3 {
+				cfg.Facility = args[2]
+			}
+		case args[0] == SinkJournald && len(args) <= 2:
+			if len(args) == 2 {
+				cfg.Address = args[1]
+			}
+		default:
+			return d.ArgErr()
+		}
+		// fail on bad addresses and facilities now, not on start
+		sink, err := NewSink(cfg)
+		if err != nil {
+			return err
+		}
+		_ = sink.Close()
+		task.LogSinks = append(task.LogSinks, cfg)
+	case "log_filter":
+		if len(args) < 1 {
+			return d.ArgErr()
+		}
+		cfg := FilterConfig{Type: args[0]}
+		switch {
+		case (args[0] == FilterStripANSI || args[0] == FilterDedup) && len(args) == 1:
+		case args[0] == FilterRedact && (len(args) == 2 || len(args) == 3):
+			cfg.Pattern = args[1]
+			if len(args) == 3 {
+				cfg.Replace = args[2]
+			}
+		case args[0] == FilterRateLimit && (len(args) == 2 || len(args) == 3):
+			var err error
+			if cfg.Rate, err = strconv.Atoi(args[1]); err != nil {
+				return d.Errf("rate_limit must be a positive number")
+			}
+			if len(args) == 3 {
+				if cfg.Burst, err = strconv.Atoi(args[2]); err != nil || cfg.Burst <= 0 {
+					return d.Errf("burst of rate_limit must be a positive number")
+				}
+			}
+		default:
+			return d.ArgErr()
+		}
+		// fail on bad patterns now, not on start
+		if _, err := NewFilter(cfg, nil); err != nil {
+			return d.Err(err.Error())
+		}
+		task.LogFilters = append(task.LogFilters, cfg)
+	case "critical":
+		if len(args) != 0 {
+			return d.ArgErr()
+		}
+		task.Critical = true
+	case "restart":
+		if len(args) != 1 {
+			return d.ArgErr()
+		}
+		if !ValidRestart(args[0]) {
+			return d.Errf("unknown restart policy %s", args[0])
+		}
+		task.Restart = args[0]
+	case "max_restarts":
+		if len(args) != 1 {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return d.Errf("max_restarts must be a number")
+		}
+		task.MaxRestarts = n
 	default:
 		return errors.New("unsupported directive " + key)
 	}
 	return nil
 }
+
+// parseLogBlock reads the directives of a log block up to its closing brace,
+// the opening brace has already been consumed.
+func parseLogBlock(cfg *LogConfig, d *caddyfile.Dispenser) error {
+	for d.Next() {
+		key := d.Val()
+		if key == "}" {
+			return nil
+		}
+		args := d.RemainingArgs()
+		switch key {
+		case "path":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			cfg.Path = args[0]
+		case "stderr_path":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			cfg.StderrPath = args[0]
+		case "max_size", "max_backups", "max_age":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return d.Errf("%s must be a non-negative number", key)
+			}
+			switch key {
+			case "max_size":
+				cfg.MaxSize = n
+			case "max_backups":
+				cfg.MaxBackups = n
+			case "max_age":
+				cfg.MaxAge = n
+			}
+		case "buffer":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return d.Errf("buffer must be a positive number")
+			}
+			cfg.Buffer = n
+		case "overflow":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if !ValidOverflow(args[0]) {
+				return d.Errf("unknown overflow policy %s", args[0])
+			}
+			cfg.Overflow = args[0]
+		case "max_line":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return d.Errf("max_line must be a positive number")
+			}
+			cfg.MaxLine = n
+		case "flush_partial":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(args[0])
+			if err != nil || dur < 0 {
+				return d.Errf("flush_partial must be a duration like 500ms")
+			}
+			cfg.FlushPartial = dur
+		case "compress", "raw":
+			b := true
+			switch {
+			case len(args) == 0:
+			case len(args) == 1:
+				var err error
+				if b, err = strconv.ParseBool(args[0]); err != nil {
+					return d.Errf("%s must be true or false", key)
+				}
+			default:
+				return d.ArgErr()
+			}
+			if key == "compress" {
+				cfg.Compress = b
+			} else {
+				cfg.Raw = b
+			}
+		default:
+			return errors.New("unsupported log directive " + key)
+		}
+	}
+	return d.EOFErr()
+}
@@ -1,15 +1,23 @@
 package spm
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
 
 var procfile = `
-# task: echo "comment line"
-chord: make dev
+# task comment { command echo "comment line" }
+task chord {
+	command make dev
+}
 # start redis
-redis: redis-server
+task redis {
+	command redis-server
+}
 `
 
 func TestParser(t *testing.T) {
@@ -25,14 +33,180 @@ func TestParser(t *testing.T) {
 		t.Error("wrong job name")
 	}
 
-	if job.Command != "make dev" {
+	if strings.Join(job.Command, " ") != "make dev" {
 		t.Error("wrong command")
 	}
 
 	if job1.Name != "redis" {
 		t.Error("wrong job name")
 	}
-	if job1.Command != "redis-server" {
+	if strings.Join(job1.Command, " ") != "redis-server" {
 		t.Error("wrong command")
 	}
 }
+
+var logProcfile = `
+task web {
+	command http-server -p 8080
+	log {
+		path web/access.log
+		max_size 10
+		max_backups 3
+		compress
+		overflow drop_oldest
+	}
+	env PORT=8080
+}
+task worker {
+	command worker
+}
+`
+
+func TestParserLogBlock(t *testing.T) {
+	p := NewParser(strings.NewReader(logProcfile))
+	tasks, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2", len(tasks))
+	}
+
+	web := tasks[0]
+	if web.Log == nil {
+		t.Fatal("log block of web not parsed")
+	}
+	want := LogConfig{Path: "web/access.log", MaxSize: 10, MaxBackups: 3, MaxAge: 7, Compress: true,
+		Buffer: DefaultLogBuffer, Overflow: OverflowDropOldest,
+		MaxLine: DefaultMaxLine, FlushPartial: DefaultFlushPartial}
+	if *web.Log != want {
+		t.Errorf("got log config %+v, want %+v", *web.Log, want)
+	}
+	if len(web.Env) != 1 || web.Env[0] != "PORT=8080" {
+		t.Error("directives after the log block are lost")
+	}
+	if tasks[1].Log != nil {
+		t.Error("worker should use the default log config")
+	}
+}
+
+func TestParserLogFilter(t *testing.T) {
+	p := NewParser(strings.NewReader(`
+task web {
+	command http-server
+	log_filter strip_ansi
+	log_filter redact "token=[^ ]+" token=***
+	log_filter rate_limit 100 500
+}
+`))
+	tasks, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FilterConfig{
+		{Type: FilterStripANSI},
+		{Type: FilterRedact, Pattern: "token=[^ ]+", Replace: "token=***"},
+		{Type: FilterRateLimit, Rate: 100, Burst: 500},
+	}
+	if !reflect.DeepEqual(tasks[0].LogFilters, want) {
+		t.Errorf("got filters %+v, want %+v", tasks[0].LogFilters, want)
+	}
+
+	p = NewParser(strings.NewReader("task web {\n\tcommand http-server\n\tlog_filter redact \"(\"\n}\n"))
+	if _, err := p.Parse(); err == nil {
+		t.Error("bad redact pattern accepted")
+	}
+}
+
+func TestParserRestart(t *testing.T) {
+	p := NewParser(strings.NewReader("task web {\n\tcommand http-server\n\trestart on-failure\n\tmax_restarts 5\n}\n"))
+	tasks, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks[0].Restart != RestartOnFailure || tasks[0].MaxRestarts != 5 {
+		t.Errorf("got restart %q with %d restarts", tasks[0].Restart, tasks[0].MaxRestarts)
+	}
+
+	p = NewParser(strings.NewReader("task web {\n\tcommand http-server\n\trestart sometimes\n}\n"))
+	if _, err := p.Parse(); err == nil {
+		t.Error("unknown restart policy accepted")
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "Procfile")
+	err = ioutil.WriteFile(filename, []byte(`
+task web {
+	command http-server
+	dir public
+}
+task worker {
+	command worker
+	dir /srv/worker
+}
+task cron {
+	command cron
+}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := ParseFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 3 {
+		t.Fatalf("got %d tasks, want 3", len(tasks))
+	}
+	dirs := []string{filepath.Join(dir, "public"), "/srv/worker", ""}
+	for i, task := range tasks {
+		if task.Dir != dirs[i] {
+			t.Errorf("got dir %q for %s, want %q", task.Dir, task.Name, dirs[i])
+		}
+		if task.Procfile != filename {
+			t.Errorf("got Procfile %q for %s, want %q", task.Procfile, task.Name, filename)
+		}
+	}
+
+	tasks, err = LoadTasks(filename, []string{"cron", "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 || tasks[0].Name != "cron" || tasks[1].Name != "web" {
+		t.Errorf("got tasks %+v, want cron and web", tasks)
+	}
+	if _, err := LoadTasks(filename, []string{"db"}); err == nil {
+		t.Error("unknown task db loaded")
+	}
+	if _, err := LoadTasks(filepath.Join(dir, "missing"), nil); err == nil {
+		t.Error("missing Procfile loaded")
+	}
+
+	// without a file relative dirs have nothing to be relative to
+	p := NewParser(strings.NewReader("task web {\n\tcommand http-server\n\tdir public\n}\n"))
+	if _, err := p.Parse(); err == nil {
+		t.Error("relative dir accepted without a Procfile")
+	}
+}
+
+func TestParserRawLog(t *testing.T) {
+	for _, procfile := range []string{
+		"task web {\n\tcommand http-server\n\tlog {\n\t\traw\n\t}\n\tlog_filter strip_ansi\n}\n",
+		"task web {\n\tlog_sink journald\n\tcommand http-server\n\tlog {\n\t\traw true\n\t}\n}\n",
+	} {
+		if _, err := NewParser(strings.NewReader(procfile)).Parse(); err == nil {
+			t.Errorf("raw log with filters or sinks accepted: %q", procfile)
+		}
+	}
+	p := NewParser(strings.NewReader("task web {\n\tcommand http-server\n\tlog {\n\t\traw false\n\t}\n\tlog_filter strip_ansi\n}\n"))
+	if _, err := p.Parse(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,452 @@
+package spm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// States of a task.
+const (
+	// StateStarting is the state while the need commands of a task run and
+	// its command is started.
+	StateStarting = "starting"
+	// StateRunning is the state while the command of a task runs.
+	StateRunning = "running"
+	// StateStopping is the state of a task that was asked to stop and has
+	// not ended yet.
+	StateStopping = "stopping"
+	// StateBackoff is the state of a task that ended and waits to be
+	// restarted.
+	StateBackoff = "backoff"
+	// StateStopped is the final state of a task that was stopped.
+	StateStopped = "stopped"
+	// StateExited is the final state of a task that ended on its own.
+	StateExited = "exited"
+	// StateFailed is the final state of a task that could not be started, or
+	// was restarted too often.
+	StateFailed = "failed"
+)
+
+// finalState reports whether a task in state is done for good.
+func finalState(state string) bool {
+	return state == StateStopped || state == StateExited || state == StateFailed
+}
+
+// Restart policies of tasks.
+const (
+	RestartNever = "never"
+	// RestartOnFailure restarts a task that ended with a non-zero exit code
+	// or could not be started again.
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// ValidRestart reports whether policy is a known restart policy.
+func ValidRestart(policy string) bool {
+	switch policy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+		return true
+	}
+	return false
+}
+
+// Defaults of Manager.Backoff and Manager.MaxBackoff.
+const (
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// proc supervises a task. Its state is changed by its supervise goroutine
+// only, other goroutines read it under mu and ask for a stop with
+// requestStop.
+type proc struct {
+	m    *Manager
+	task Task
+	seq  uint64        // start order
+	stop chan struct{} // closed by requestStop
+	done chan struct{} // closed once the task is in a final state
+	ran  bool          // the command ran at least once, owned by supervise
+
+	mu       sync.Mutex // protects following
+	state    string
+	run      *procRun
+	stopSig  os.Signal
+	stopBy   string             // client that requested the stop
+	cancel   context.CancelFunc // cancels a start in progress
+	restarts int
+	exitCode int
+	err      error
+}
+
+// procRun is a single run of the command of a task.
+type procRun struct {
+	process   *os.Process
+	pid       int
+	startTime uint64
+	started   time.Time
+	logger    *Logger
+	// output is done once stdout and stderr of the command are read to the
+	// end.
+	output *sync.WaitGroup
+	wait   chan error    // receives the result of waiting for the process
+	ended  chan struct{} // closed once the process ended
+
+	// last CPU sample and the usage derived from it, protected by the mu
+	// of the proc
+	sampled   time.Time
+	sampleCPU time.Duration
+	cpu       float64
+}
+
+// usage is the resource usage of a process group.
+type usage struct {
+	CPU   time.Duration // user and system time
+	RSS   uint64        // resident memory in bytes
+	FDs   int           // open file descriptors
+	Procs int           // processes in the group
+}
+
+// procStat is the part of /proc/<pid>/stat spm uses.
+type procStat struct {
+	Pid   int
+	Comm  string
+	State string
+	PPid  int
+	Pgrp  int
+	// CPU is the time spent in user and kernel mode.
+	CPU     time.Duration
+	Threads int
+	// StartTime is the start time in clock ticks since boot.
+	StartTime uint64
+	// RSS is the resident memory in bytes.
+	RSS uint64
+}
+
+// sampleInterval is the shortest interval CPU usage is measured over.
+const sampleInterval = time.Second
+
+// supervise runs the task until it reaches a final state, starting with r
+// if it is not nil. started receives the result of the first start, which
+// is bounded by ctx.
+func (p *proc) supervise(ctx context.Context, r *procRun, started chan<- error) {
+	defer close(p.done)
+	m := p.m
+	delay := m.backoff()
+	failures := 0
+	for {
+		var err error
+		if r == nil {
+			r, err = p.start(ctx)
+		}
+		ctx = context.Background()
+		if started != nil && err != nil {
+			if p.stopRequested() {
+				p.finish(StateStopped, nil)
+			} else {
+				p.finish(StateFailed, err)
+			}
+			started <- err
+			return
+		}
+
+		if err == nil {
+			p.running(r)
+			if started != nil {
+				started <- nil
+				started = nil
+			}
+			err = p.wait(r)
+			p.ended(r, err)
+			if time.Since(r.started) > m.maxBackoff() {
+				// it ran long enough to count as a success
+				failures = 0
+				delay = m.backoff()
+			}
+			r = nil
+		} else if !p.stopRequested() {
+			m.logf("restart task `%s`: %s", p.task.Name, err)
+		}
+
+		if p.stopRequested() {
+			p.finish(StateStopped, nil)
+			return
+		}
+		if !p.shouldRestart(err) {
+			p.finish(StateExited, nil)
+			return
+		}
+		failures++
+		if max := p.task.MaxRestarts; max > 0 && failures > max {
+			p.finish(StateFailed, fmt.Errorf("gave up after %d restarts", max))
+			return
+		}
+		if !p.backoff(delay) {
+			p.finish(StateStopped, nil)
+			return
+		}
+		if delay *= 2; delay > m.maxBackoff() {
+			delay = m.maxBackoff()
+		}
+		p.mu.Lock()
+		p.restarts++
+		p.mu.Unlock()
+	}
+}
+
+// start runs the need commands of the task and starts its command. A stop
+// request cancels it.
+func (p *proc) start(ctx context.Context) (*procRun, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p.mu.Lock()
+	if p.stopSig != nil {
+		p.mu.Unlock()
+		return nil, context.Canceled
+	}
+	p.state = StateStarting
+	p.cancel = cancel
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.cancel = nil
+		p.mu.Unlock()
+	}()
+	return p.m.launch(ctx, p.task)
+}
+
+// running makes r the current run of the task.
+func (p *proc) running(r *procRun) {
+	p.mu.Lock()
+	p.state = StateRunning
+	p.run = r
+	restarts := p.restarts
+	p.mu.Unlock()
+	p.ran = true
+	p.m.saveState()
+
+	p.m.logf("task `%s` has been started", p.task.Name)
+	p.m.emit(Event{Type: EventStarted, Task: p.task.Name, Pid: r.pid})
+	if restarts > 0 {
+		p.m.emit(Event{Type: EventRestarted, Task: p.task.Name, Pid: r.pid})
+	}
+	go p.m.checkReady(p.task, r)
+}
+
+// wait waits for the end of r. A stop request signals the process, and
+// kills its process group once StopTimeout has passed.
+func (p *proc) wait(r *procRun) error {
+	stop := p.stop
+	var timeout <-chan time.Time
+	for {
+		select {
+		case err := <-r.wait:
+			return err
+		case <-stop:
+			stop = nil
+			p.mu.Lock()
+			p.state = StateStopping
+			sig := p.stopSig
+			p.mu.Unlock()
+			if err := r.process.Signal(sig); err != nil {
+				// it may have ended on its own meanwhile
+				p.m.logf("signal task `%s`: %s", p.task.Name, err)
+			}
+			if p.m.StopTimeout > 0 {
+				t := time.NewTimer(p.m.StopTimeout)
+				defer t.Stop()
+				timeout = t.C
+			}
+		case <-timeout:
+			p.m.logf("task `%s` did not stop in %s, killing it", p.task.Name, p.m.StopTimeout)
+			if err := killGroup(r.process); err != nil {
+				p.m.logf("kill task `%s`: %s", p.task.Name, err)
+			}
+			timeout = nil
+		}
+	}
+}
+
+// ended cleans up after r, err is the result of waiting for it.
+func (p *proc) ended(r *procRun, err error) {
+	p.m.closeLogger(p.task, r)
+	code := exitCode(err)
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		p.m.logf("wait for task `%s`: %s", p.task.Name, err)
+	}
+	p.m.logf("task `%s` ended with code %d", p.task.Name, code)
+
+	p.mu.Lock()
+	p.run = nil
+	p.exitCode = code
+	p.mu.Unlock()
+	close(r.ended)
+	p.m.emit(Event{Type: EventExited, Task: p.task.Name, Pid: r.pid, ExitCode: code})
+}
+
+// shouldRestart reports whether the restart policy of the task asks for
+// another run, err is the result of the last one.
+func (p *proc) shouldRestart(err error) bool {
+	switch p.task.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// backoff waits for delay before the next restart, it reports false if the
+// task was stopped meanwhile.
+func (p *proc) backoff(delay time.Duration) bool {
+	p.mu.Lock()
+	if p.stopSig != nil {
+		p.mu.Unlock()
+		return false
+	}
+	p.state = StateBackoff
+	p.mu.Unlock()
+	p.m.saveState()
+	p.m.logf("task `%s` restarts in %s", p.task.Name, delay)
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-p.stop:
+		return false
+	}
+}
+
+// finish puts the task into a final state.
+func (p *proc) finish(state string, err error) {
+	// while the state isn't final yet, no new run can have replaced the
+	// FIFOs
+	p.m.removeOutput(p.task.Name)
+	p.mu.Lock()
+	p.state = state
+	p.err = err
+	code := p.exitCode
+	by := p.stopBy
+	p.mu.Unlock()
+	if err != nil {
+		p.m.logf("task `%s` failed: %s", p.task.Name, err)
+	}
+	if state == StateStopped {
+		p.m.emit(Event{Type: EventStopped, Task: p.task.Name, ExitCode: code, By: by})
+	}
+
+	m := p.m
+	m.mu.Lock()
+	shutdown := m.shutdown
+	m.mu.Unlock()
+	// tasks stopped by a daemon shutdown stay in the state file, they are
+	// supposed to be running once the daemon is back
+	if shutdown {
+		return
+	}
+	m.saveState()
+	if p.task.Critical && p.ran && state != StateStopped && m.CriticalExit != nil {
+		if code == 0 && state == StateFailed {
+			code = 1
+		}
+		select {
+		case m.CriticalExit <- code:
+		default:
+		}
+	}
+}
+
+// requestStop asks the task to stop with sig on behalf of the client by. It
+// reports false if the task is already in a final state. Further requests
+// wait for the first one.
+func (p *proc) requestStop(sig os.Signal, by string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if finalState(p.state) {
+		return false
+	}
+	if p.stopSig == nil {
+		p.stopSig = sig
+		p.stopBy = by
+		close(p.stop)
+		if p.cancel != nil {
+			p.cancel()
+		}
+	}
+	return true
+}
+
+func (p *proc) stopRequested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopSig != nil
+}
+
+// status returns the status of p. usages are the usages of process groups,
+// nil if unknown.
+func (p *proc) status(usages map[int]usage) TaskStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := TaskStatus{
+		Name:     p.task.Name,
+		State:    p.state,
+		Command:  p.task.Command,
+		Procfile: p.task.Procfile,
+		Restarts: p.restarts,
+		ExitCode: p.exitCode,
+	}
+	if p.err != nil {
+		s.Error = p.err.Error()
+	}
+	if r := p.run; r != nil {
+		s.Pid = r.pid
+		s.Started = r.started
+		s.LogFile = r.logger.FileName()
+		s.LogDropped = r.logger.Dropped()
+		if u, ok := usages[r.pid]; ok && !finalState(p.state) {
+			s.CPU = r.sample(u.CPU)
+			s.Memory = u.RSS
+		}
+	}
+	return s
+}
+
+// sample records the CPU time of r and returns its usage in percent of a
+// core since the previous sample, or since the start of r for the first
+// one. Samples closer than sampleInterval return the previous usage.
+func (r *procRun) sample(cpu time.Duration) float64 {
+	now := time.Now()
+	since, prev := r.started, time.Duration(0)
+	if !r.sampled.IsZero() {
+		if now.Sub(r.sampled) < sampleInterval {
+			return r.cpu
+		}
+		since, prev = r.sampled, r.sampleCPU
+	}
+	if elapsed := now.Sub(since); elapsed > 0 && cpu >= prev {
+		r.cpu = float64(cpu-prev) / float64(elapsed) * 100
+	}
+	r.sampled, r.sampleCPU = now, cpu
+	return r.cpu
+}
+
+// pid returns the pid of the running command of p, 0 if it doesn't run.
+func (p *proc) pid() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.run == nil || finalState(p.state) {
+		return 0
+	}
+	return p.run.pid
+}
+
+func (p *proc) final() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return finalState(p.state)
+}
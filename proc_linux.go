@@ -0,0 +1,194 @@
+package spm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of times in /proc, which is 100 on all
+// architectures Linux runs on today.
+const clockTicks = 100
+
+// readProcStat reads the stat of pid.
+func readProcStat(pid int) (procStat, error) {
+	st := procStat{Pid: pid}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return st, err
+	}
+	// the command name may contain spaces, fields are counted after it
+	s := string(b)
+	i, j := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if i < 0 || j < i {
+		return st, fmt.Errorf("malformed stat of pid %d", pid)
+	}
+	st.Comm = s[i+1 : j]
+	fields := strings.Fields(s[j+1:])
+	// fields[0] is field 3 (state), starttime is field 22 and rss field 24
+	if len(fields) < 22 {
+		return st, fmt.Errorf("malformed stat of pid %d", pid)
+	}
+	st.State = fields[0]
+	st.PPid, _ = strconv.Atoi(fields[1])
+	st.Pgrp, _ = strconv.Atoi(fields[2])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	st.CPU = time.Duration(utime+stime) * time.Second / clockTicks
+	st.Threads, _ = strconv.Atoi(fields[17])
+	st.StartTime, err = strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return st, fmt.Errorf("malformed stat of pid %d", pid)
+	}
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+	st.RSS = rss * uint64(os.Getpagesize())
+	return st, nil
+}
+
+// processStartTime returns the start time of pid in clock ticks since boot.
+func processStartTime(pid int) (uint64, error) {
+	st, err := readProcStat(pid)
+	return st.StartTime, err
+}
+
+// allProcStats returns the stat of every process.
+func allProcStats() ([]procStat, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]procStat, 0, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// processes may end while we look
+		if st, err := readProcStat(pid); err == nil {
+			stats = append(stats, st)
+		}
+	}
+	return stats, nil
+}
+
+// groupUsages sums the resource usage of the processes in each of the
+// process groups pgrps, keyed by the id of the group. Tasks run in a group
+// of their own, with the id of their pid.
+func groupUsages(pgrps []int) (map[int]usage, error) {
+	usages := make(map[int]usage, len(pgrps))
+	if len(pgrps) == 0 {
+		return usages, nil
+	}
+	wanted := make(map[int]bool, len(pgrps))
+	for _, pgrp := range pgrps {
+		wanted[pgrp] = true
+	}
+	stats, err := allProcStats()
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range stats {
+		if !wanted[st.Pgrp] {
+			continue
+		}
+		u := usages[st.Pgrp]
+		u.CPU += st.CPU
+		u.RSS += st.RSS
+		u.FDs += countFDs(st.Pid)
+		u.Procs++
+		usages[st.Pgrp] = u
+	}
+	return usages, nil
+}
+
+// countFDs returns the number of open file descriptors of pid, 0 if they
+// can't be read.
+func countFDs(pid int) int {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(-1)
+	return len(names)
+}
+
+// bootTime returns the time the system booted.
+func bootTime() (time.Time, error) {
+	b, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			sec, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				break
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no boot time in /proc/stat")
+}
+
+// startedAt returns the time st was started, given the boot time.
+func (st procStat) startedAt(boot time.Time) time.Time {
+	return boot.Add(time.Duration(st.StartTime) * time.Second / clockTicks)
+}
+
+// processUID returns the real user id of pid.
+func processUID(pid int) (string, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "Uid:") {
+			if fields := strings.Fields(line[len("Uid:"):]); len(fields) > 0 {
+				return fields[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no uid of pid %d", pid)
+}
+
+// processCommand returns the command line of pid, nil for kernel threads
+// and zombies.
+func processCommand(pid int) []string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+}
+
+// peerUser returns the user of the process on the other end of the unix
+// connection c.
+func peerUser(c net.Conn) (string, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return "", fmt.Errorf("%s is not a unix connection", c.RemoteAddr())
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return "", err
+	}
+	if credErr != nil {
+		return "", credErr
+	}
+	return userName(strconv.Itoa(int(cred.Uid))), nil
+}
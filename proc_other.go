@@ -0,0 +1,47 @@
+// +build !linux
+
+package spm
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errNoProc = errors.New("process information is not supported on this platform")
+
+func processStartTime(pid int) (uint64, error) {
+	return 0, errNoProc
+}
+
+func groupUsages(pgrps []int) (map[int]usage, error) {
+	return nil, errNoProc
+}
+
+func allProcStats() ([]procStat, error) {
+	return nil, errNoProc
+}
+
+func bootTime() (time.Time, error) {
+	return time.Time{}, errNoProc
+}
+
+func (st procStat) startedAt(boot time.Time) time.Time {
+	return boot
+}
+
+func processUID(pid int) (string, error) {
+	return "", errNoProc
+}
+
+func processCommand(pid int) []string {
+	return nil
+}
+
+func countFDs(pid int) int {
+	return 0
+}
+
+func peerUser(c net.Conn) (string, error) {
+	return "", errNoProc
+}
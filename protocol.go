@@ -0,0 +1,221 @@
+package spm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version of spm.
+const Version = "0.0.1"
+
+// ProtocolVersion is the version of the protocol spoken on the socket of the
+// daemon. A client and a daemon of different versions refuse to talk to
+// each other.
+const ProtocolVersion = 2
+
+// Methods of requests.
+const (
+	MethodStart     = "start"
+	MethodStop      = "stop"
+	MethodRestart   = "restart"
+	MethodStatus    = "status"
+	MethodList      = "list"
+	MethodSave      = "save"
+	MethodResurrect = "resurrect"
+	MethodRotate    = "rotate"
+	MethodScale     = "scale"
+	MethodPs        = "ps"
+	MethodLog       = "log"
+	MethodGrep      = "grep"
+	MethodEvents    = "events"
+	// MethodCancel ends the stream of an earlier request.
+	MethodCancel = "cancel"
+)
+
+// Codes of errors in responses.
+const (
+	CodeVersionMismatch = "version_mismatch"
+	CodeBadRequest      = "bad_request"
+	CodeUnknownMethod   = "unknown_method"
+	CodeNotFound        = "not_found"
+	CodeForbidden       = "forbidden"
+	CodeFailed          = "failed"
+)
+
+// Hello is the first message each side of a connection sends, the client
+// first. A daemon that refuses the client sets Error, which is a string so
+// that clients of the first protocol print it as well.
+type Hello struct {
+	Protocol int
+	Version  string
+	Error    string `json:",omitempty"`
+}
+
+// Request asks the daemon to run Method. ID is chosen by the client, the
+// responses to the request carry it.
+type Request struct {
+	ID     uint64
+	Method string
+	Params json.RawMessage `json:",omitempty"`
+}
+
+// Decode decodes the parameters of r into v.
+func (r *Request) Decode(v interface{}) error {
+	if len(r.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(r.Params, v); err != nil {
+		return &Error{Code: CodeBadRequest, Message: fmt.Sprintf("bad parameters of %s: %s", r.Method, err)}
+	}
+	return nil
+}
+
+// Response answers the request with the same ID. Streaming requests get
+// several responses, the last one has Done set, other requests get one.
+type Response struct {
+	ID     uint64
+	Done   bool
+	Error  *Error          `json:",omitempty"`
+	Result json.RawMessage `json:",omitempty"`
+}
+
+// Error is the error of a failed request.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// toError turns err into the Error of a response.
+func toError(err error) *Error {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return err
+	case *NotFoundError:
+		return &Error{Code: CodeNotFound, Message: err.Error()}
+	}
+	return &Error{Code: CodeFailed, Message: err.Error()}
+}
+
+// StartParams are the parameters of MethodStart.
+type StartParams struct {
+	// Procfile is the absolute path of a Procfile for the daemon to parse,
+	// Tasks are the names of the tasks in it to start, all if empty.
+	Procfile string
+	Tasks    []string
+	// Jobs are started as they are.
+	Jobs []Task
+}
+
+// StopParams are the parameters of MethodStop, no tasks stops all.
+type StopParams struct {
+	Tasks []string
+}
+
+// RestartParams are the parameters of MethodRestart.
+type RestartParams struct {
+	Tasks []string
+}
+
+// StatusParams are the parameters of MethodStatus, no tasks selects all
+// started tasks.
+type StatusParams struct {
+	Tasks []string
+}
+
+// StatusResult is the result of MethodStatus.
+type StatusResult struct {
+	Tasks []TaskStatus
+}
+
+// PsParams are the parameters of MethodPs, no tasks selects all running
+// tasks.
+type PsParams struct {
+	Tasks []string
+}
+
+// PsResult is the result of MethodPs.
+type PsResult struct {
+	Processes []ProcessInfo
+}
+
+// ListResult is the result of MethodList.
+type ListResult struct {
+	Tasks []string
+}
+
+// ScaleParams are the parameters of MethodScale.
+type ScaleParams struct {
+	Task  string
+	Count int
+}
+
+// SaveParams are the parameters of MethodSave and MethodResurrect, an empty
+// File is DefaultDumpFile.
+type SaveParams struct {
+	File string
+}
+
+// RotateParams are the parameters of MethodRotate.
+type RotateParams struct {
+	Tasks []string
+}
+
+// LogParams are the parameters of MethodLog, no tasks selects all known
+// tasks. A followed log is streamed until it is canceled.
+type LogParams struct {
+	Tasks  []string
+	Tail   int
+	Stream string
+	Follow bool
+	Raw    bool
+}
+
+// LogResult is a result of MethodLog and MethodGrep. The first result of a
+// log names the tasks it has lines of.
+type LogResult struct {
+	Tasks []string `json:",omitempty"`
+	Lines []LogLine
+}
+
+// GrepParams are the parameters of MethodGrep, its results are streamed.
+type GrepParams struct {
+	Task         string
+	Pattern      string
+	Since, Until time.Time
+	Context      int
+	Stream       string
+}
+
+// EventsParams are the parameters of MethodEvents, its results are the
+// Event values of the selected tasks and types, all if none are given.
+type EventsParams struct {
+	Tasks []string
+	Types []string
+}
+
+// Match reports whether e is selected by p.
+func (p EventsParams) Match(e Event) bool {
+	return matchAny(p.Tasks, e.Task) && matchAny(p.Types, e.Type)
+}
+
+// matchAny reports whether values is empty or contains s.
+func matchAny(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return len(values) == 0
+}
+
+// CancelParams are the parameters of MethodCancel.
+type CancelParams struct {
+	ID uint64
+}
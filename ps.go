@@ -0,0 +1,145 @@
+package spm
+
+import (
+	"os/user"
+	"sort"
+	"time"
+)
+
+// ProcessInfo describes a process of a running task.
+type ProcessInfo struct {
+	Task string
+	Pid  int
+	PPid int
+	Pgid int
+	// Depth is the depth of the process in the tree of the task, 0 for the
+	// process the task started.
+	Depth int
+	User  string
+	// State is the state of the process as ps shows it, e.g. R or S.
+	State   string
+	Started time.Time
+	// CPUTime is the time spent in user and kernel mode, CPU its average in
+	// percent of one core since the process started.
+	CPUTime time.Duration
+	CPU     float64
+	// RSS is the resident memory in bytes.
+	RSS     uint64
+	Threads int
+	FDs     int
+	// Children counts the child processes.
+	Children int
+	Command  []string
+}
+
+// Processes returns the processes of the tasks listed in names, or of all
+// running tasks when names is empty. The processes of a task are its whole
+// process tree, including orphans that stayed in its process group, with
+// parents before their children.
+func (m *Manager) Processes(names ...string) ([]ProcessInfo, error) {
+	m.mu.Lock()
+	if len(names) == 0 {
+		for name := range m.procs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	procs := make([]*proc, 0, len(names))
+	for _, name := range names {
+		p, exists := m.procs[name]
+		if !exists {
+			m.mu.Unlock()
+			return nil, &NotFoundError{Task: name, Reason: "has not been started"}
+		}
+		procs = append(procs, p)
+	}
+	m.mu.Unlock()
+
+	stats, err := allProcStats()
+	if err != nil {
+		return nil, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return nil, err
+	}
+	byPid := make(map[int]procStat, len(stats))
+	children := make(map[int][]int)
+	groups := make(map[int][]int)
+	for _, st := range stats {
+		byPid[st.Pid] = st
+		children[st.PPid] = append(children[st.PPid], st.Pid)
+		groups[st.Pgrp] = append(groups[st.Pgrp], st.Pid)
+	}
+	for _, pids := range children {
+		sort.Ints(pids)
+	}
+	for _, pids := range groups {
+		sort.Ints(pids)
+	}
+
+	now := time.Now()
+	users := make(map[string]string)
+	var infos []ProcessInfo
+	for _, p := range procs {
+		root := p.pid()
+		if _, ok := byPid[root]; !ok {
+			continue
+		}
+		visited := make(map[int]bool)
+		var walk func(pid, depth int)
+		walk = func(pid, depth int) {
+			if visited[pid] {
+				return
+			}
+			visited[pid] = true
+			st := byPid[pid]
+			info := ProcessInfo{
+				Task:     p.task.Name,
+				Pid:      pid,
+				PPid:     st.PPid,
+				Pgid:     st.Pgrp,
+				Depth:    depth,
+				State:    st.State,
+				Started:  st.startedAt(boot),
+				CPUTime:  st.CPU,
+				RSS:      st.RSS,
+				Threads:  st.Threads,
+				FDs:      countFDs(pid),
+				Children: len(children[pid]),
+				Command:  processCommand(pid),
+			}
+			if info.Command == nil {
+				info.Command = []string{"[" + st.Comm + "]"}
+			}
+			if elapsed := now.Sub(info.Started); elapsed > 0 {
+				info.CPU = float64(st.CPU) / float64(elapsed) * 100
+			}
+			if uid, err := processUID(pid); err == nil {
+				if _, ok := users[uid]; !ok {
+					users[uid] = userName(uid)
+				}
+				info.User = users[uid]
+			}
+			infos = append(infos, info)
+			for _, child := range children[pid] {
+				walk(child, depth+1)
+			}
+		}
+		walk(root, 0)
+		// orphans of the task are adopted by init, or a subreaper, but
+		// stay in its process group
+		for _, pid := range groups[root] {
+			walk(pid, 1)
+		}
+	}
+	return infos, nil
+}
+
+// userName returns the name of the user with uid, uid if it is unknown.
+func userName(uid string) string {
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
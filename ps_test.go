@@ -0,0 +1,44 @@
+package spm
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestManagerProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc")
+	}
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	task := Task{Name: "tree", Command: []string{"sh", "-c", "sleep 30 & wait"}}
+	if err := m.Start(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+
+	// the child is started in the background
+	var ps []ProcessInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ps) < 2 && time.Now().Before(deadline) {
+		var err error
+		if ps, err = m.Processes(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(ps) != 2 {
+		t.Fatalf("got processes %+v, want shell and sleep", ps)
+	}
+	root, child := ps[0], ps[1]
+	if root.Depth != 0 || root.Children != 1 || root.Pgid != root.Pid || root.User == "" {
+		t.Errorf("bad root process %+v", root)
+	}
+	if child.Depth != 1 || child.PPid != root.Pid || child.Pgid != root.Pid || child.Command[0] != "sleep" {
+		t.Errorf("bad child process %+v", child)
+	}
+	if _, err := m.Processes("db"); err == nil {
+		t.Error("got processes of unknown task")
+	}
+}
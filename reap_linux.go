@@ -0,0 +1,67 @@
+package spm
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetSubreaper makes orphaned descendants of the daemon its children rather
+// than children of init, so that they can be reaped by ReapOrphans. It is not
+// needed when the daemon runs as pid 1.
+func SetSubreaper() error {
+	if os.Getpid() == 1 {
+		return nil
+	}
+	return unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+}
+
+// NotifyOrphans relays SIGCHLD to c, for calling ReapOrphans when a child
+// ended.
+func NotifyOrphans(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGCHLD)
+}
+
+// ReapOrphans waits for every zombie child that was not started by the
+// manager. Children of the manager are left to their exec.Cmd.
+func (m *Manager) ReapOrphans() {
+	m.childMu.Lock()
+	defer m.childMu.Unlock()
+
+	ppid := os.Getpid()
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || m.children[pid] {
+			continue
+		}
+		if !isZombieChild(pid, ppid) {
+			continue
+		}
+		var ws syscall.WaitStatus
+		_, _ = syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+	}
+}
+
+func isZombieChild(pid, ppid int) bool {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	s := string(b)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return false
+	}
+	// fields after the command name start with state and ppid
+	fields := strings.Fields(s[i+1:])
+	return len(fields) > 1 && fields[0] == "Z" && fields[1] == strconv.Itoa(ppid)
+}
@@ -0,0 +1,32 @@
+package spm
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestReapOrphans(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+
+	// a child the manager didn't start and nobody waits for
+	orphan := exec.Command("true")
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := orphan.Process.Pid
+	deadline := time.Now().Add(5 * time.Second)
+	for !isZombieChild(pid, os.Getpid()) {
+		if time.Now().After(deadline) {
+			t.Fatal("child did not become a zombie")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	m.ReapOrphans()
+	if isZombieChild(pid, os.Getpid()) {
+		t.Error("zombie child was not reaped")
+	}
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package spm
+
+import (
+	"errors"
+	"os"
+)
+
+// SetSubreaper is only supported on linux.
+func SetSubreaper() error {
+	return errors.New("child subreaper is not supported on this platform")
+}
+
+// ReapOrphans is a no-op where SetSubreaper is unsupported.
+func (m *Manager) ReapOrphans() {}
+
+// NotifyOrphans is a no-op where SetSubreaper is unsupported.
+func NotifyOrphans(c chan<- os.Signal) {}
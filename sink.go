@@ -0,0 +1,335 @@
+package spm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSink receives every line of a task in addition to its log file.
+type LogSink interface {
+	WriteLine(t time.Time, task, stream string, pid int, msg []byte) error
+	Close() error
+}
+
+// Types of log sinks.
+const (
+	SinkSyslog   = "syslog"
+	SinkJournald = "journald"
+)
+
+// DefaultJournalSocket is the native protocol socket of systemd-journald.
+const DefaultJournalSocket = "/run/systemd/journal/socket"
+
+// SinkConfig is a parsed log_sink directive.
+type SinkConfig struct {
+	Type string
+	// Address is unix:///path or udp://host:port for syslog and the path
+	// of the socket for journald.
+	Address string
+	// Facility is the syslog facility, user if empty.
+	Facility string
+}
+
+// NewSink creates the sink described by cfg.
+func NewSink(cfg SinkConfig) (LogSink, error) {
+	switch cfg.Type {
+	case SinkSyslog:
+		facility, ok := syslogFacilities[cfg.Facility]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog facility %s", cfg.Facility)
+		}
+		network, addr, err := parseSinkAddress(cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		hostname, _ := os.Hostname()
+		if hostname == "" {
+			hostname = "-"
+		}
+		return &syslogSink{
+			conn:     sinkConn{network: network, addr: addr},
+			facility: facility,
+			hostname: hostname,
+		}, nil
+	case SinkJournald:
+		addr := cfg.Address
+		if addr == "" {
+			addr = DefaultJournalSocket
+		}
+		return &journaldSink{conn: sinkConn{network: "unixgram", addr: addr}}, nil
+	}
+	return nil, fmt.Errorf("unknown log sink %s", cfg.Type)
+}
+
+func parseSinkAddress(address string) (network, addr string, err error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		return "unix", u.Path, nil
+	case "udp":
+		return "udp", u.Host, nil
+	}
+	return "", "", fmt.Errorf("unsupported sink address %s, use unix:///path or udp://host:port", address)
+}
+
+// sinkTimeout bounds dialing a sink and writing to it. A sink that failed
+// is skipped for sinkRetry before it is dialed again.
+const (
+	sinkTimeout = time.Second
+	sinkRetry   = 5 * time.Second
+)
+
+// sinkConn is a lazily dialed connection that is dialed again after a
+// failed write, so that a restarted syslog or journald is picked up.
+type sinkConn struct {
+	network, addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// framed is set for stream sockets, messages are terminated by a
+	// newline there
+	framed bool
+	// failed is when the last write failed, zero after a success
+	failed time.Time
+}
+
+// write sends b as one message.
+func (c *sinkConn) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.failed.IsZero() && time.Since(c.failed) < sinkRetry {
+		return fmt.Errorf("%s %s is down", c.network, c.addr)
+	}
+	for try := 0; try < 2; try++ {
+		if c.conn == nil {
+			if err := c.dial(); err != nil {
+				c.failed = time.Now()
+				return err
+			}
+		}
+		msg := b
+		if c.framed {
+			msg = append(b[:len(b):len(b)], '\n')
+		}
+		_ = c.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+		_, err := c.conn.Write(msg)
+		if err == nil {
+			c.failed = time.Time{}
+			return nil
+		}
+		c.conn.Close()
+		c.conn = nil
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			// a sink that hangs is not restarted
+			break
+		}
+	}
+	c.failed = time.Now()
+	return fmt.Errorf("write to %s %s failed", c.network, c.addr)
+}
+
+func (c *sinkConn) dial() (err error) {
+	if c.network != "unix" {
+		c.conn, err = net.DialTimeout(c.network, c.addr, sinkTimeout)
+		return err
+	}
+	// syslog sockets are datagram sockets mostly, but not always
+	if c.conn, err = net.DialTimeout("unixgram", c.addr, sinkTimeout); err == nil {
+		c.framed = false
+		return nil
+	}
+	if c.conn, err = net.DialTimeout("unix", c.addr, sinkTimeout); err == nil {
+		c.framed = true
+	}
+	return err
+}
+
+func (c *sinkConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// sinkBuffer is the number of lines queued for a sink.
+const sinkBuffer = 1024
+
+// sinkQueue writes the lines for a sink from its own goroutine, so that a
+// sink that is slow or down doesn't hold up the task. Lines are dropped
+// while the queue is full.
+type sinkQueue struct {
+	sink LogSink
+
+	mu     sync.Mutex
+	lines  chan sinkLine
+	closed bool
+	done   chan struct{}
+}
+
+type sinkLine struct {
+	t            time.Time
+	task, stream string
+	pid          int
+	msg          []byte
+}
+
+func newSinkQueue(sink LogSink) *sinkQueue {
+	q := &sinkQueue{
+		sink:  sink,
+		lines: make(chan sinkLine, sinkBuffer),
+		done:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for line := range q.lines {
+		_ = q.sink.WriteLine(line.t, line.task, line.stream, line.pid, line.msg)
+	}
+}
+
+// WriteLine queues a copy of msg. Lines written after Close are dropped.
+func (q *sinkQueue) WriteLine(t time.Time, task, stream string, pid int, msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return fmt.Errorf("sink of %s is closed", task)
+	}
+	select {
+	case q.lines <- sinkLine{t, task, stream, pid, append([]byte(nil), msg...)}:
+		return nil
+	default:
+		return fmt.Errorf("sink of %s is full", task)
+	}
+}
+
+// Close writes the queued lines and closes the sink.
+func (q *sinkQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.lines)
+	}
+	q.mu.Unlock()
+	<-q.done
+	return q.sink.Close()
+}
+
+var syslogFacilities = map[string]int{
+	"": 1, "kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Severities lines are logged with, stderr counts as error output.
+const (
+	severityErr  = 3
+	severityInfo = 6
+)
+
+func severity(stream string) int {
+	if stream == Stderr {
+		return severityErr
+	}
+	return severityInfo
+}
+
+// syslogSink writes RFC 5424 messages.
+type syslogSink struct {
+	conn     sinkConn
+	facility int
+	hostname string
+}
+
+func (s *syslogSink) WriteLine(t time.Time, task, stream string, pid int, msg []byte) error {
+	procid := "-"
+	if pid > 0 {
+		procid = strconv.Itoa(pid)
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s - ",
+		s.facility*8+severity(stream),
+		t.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, syslogName(task), procid, stream)
+	b.Write(msg)
+	return s.conn.write(b.Bytes())
+}
+
+func (s *syslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// syslogName makes task a valid APP-NAME, printable ASCII of at most 48
+// characters.
+func syslogName(task string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, task)
+	if len(name) > 48 {
+		name = name[:48]
+	}
+	if name == "" {
+		return "-"
+	}
+	return name
+}
+
+// journaldSink speaks the native protocol of systemd-journald.
+type journaldSink struct {
+	conn sinkConn
+}
+
+func (s *journaldSink) WriteLine(t time.Time, task, stream string, pid int, msg []byte) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", []byte(strconv.Itoa(severity(stream))))
+	journalField(&b, "SYSLOG_IDENTIFIER", []byte(task))
+	if pid > 0 {
+		journalField(&b, "SYSLOG_PID", []byte(strconv.Itoa(pid)))
+	}
+	journalField(&b, "SPM_TASK", []byte(task))
+	journalField(&b, "SPM_STREAM", []byte(stream))
+	return s.conn.write(b.Bytes())
+}
+
+func (s *journaldSink) Close() error {
+	return s.conn.Close()
+}
+
+// journalField appends a field in the journal export format. Values with a
+// newline are written with an explicit length instead of =.
+func journalField(b *bytes.Buffer, key string, value []byte) {
+	b.WriteString(key)
+	if bytes.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.Write(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.Write(value)
+	b.WriteByte('\n')
+}
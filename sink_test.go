@@ -0,0 +1,243 @@
+package spm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenUnixgram stands in for /dev/log or the journald socket.
+func listenUnixgram(t *testing.T) (string, *net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "spm-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, conn, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readPacket(t *testing.T, conn net.PacketConn) []byte {
+	buf := make([]byte, 64*1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+var sinkTime = time.Date(2019, 4, 18, 15, 4, 5, 123456000, time.UTC)
+
+func TestSyslogSinkUnix(t *testing.T) {
+	path, conn, cleanup := listenUnixgram(t)
+	defer cleanup()
+
+	sink, err := NewSink(SinkConfig{Type: SinkSyslog, Address: "unix://" + path, Facility: "local0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteLine(sinkTime, "web", Stderr, 42, []byte("failed")); err != nil {
+		t.Fatal(err)
+	}
+	got := string(readPacket(t, conn))
+	// local0 is 16, err is 3
+	want := " 2019-04-18T15:04:05.123456Z "
+	if !strings.HasPrefix(got, "<131>1"+want) || !strings.HasSuffix(got, " web 42 stderr - failed") {
+		t.Errorf("unexpected syslog message %q", got)
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewSink(SinkConfig{Type: SinkSyslog, Address: "udp://" + conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteLine(sinkTime, "worker", Stdout, 0, []byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	got := string(readPacket(t, conn))
+	// user is 1, info is 6
+	if !strings.HasPrefix(got, "<14>1 ") || !strings.HasSuffix(got, " worker - stdout - done") {
+		t.Errorf("unexpected syslog message %q", got)
+	}
+}
+
+func TestJournaldSink(t *testing.T) {
+	path, conn, cleanup := listenUnixgram(t)
+	defer cleanup()
+
+	sink, err := NewSink(SinkConfig{Type: SinkJournald, Address: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteLine(sinkTime, "web", Stderr, 42, []byte("two\nlines")); err != nil {
+		t.Fatal(err)
+	}
+	got := readPacket(t, conn)
+
+	var message bytes.Buffer
+	message.WriteString("MESSAGE\n")
+	_ = binary.Write(&message, binary.LittleEndian, uint64(9))
+	message.WriteString("two\nlines\n")
+	if !bytes.HasPrefix(got, message.Bytes()) {
+		t.Errorf("multiline MESSAGE not in binary format: %q", got)
+	}
+	for _, field := range []string{"PRIORITY=3\n", "SYSLOG_IDENTIFIER=web\n", "SYSLOG_PID=42\n", "SPM_TASK=web\n", "SPM_STREAM=stderr\n"} {
+		if !bytes.Contains(got, []byte(field)) {
+			t.Errorf("field %q missing in %q", field, got)
+		}
+	}
+}
+
+func TestNewSinkErrors(t *testing.T) {
+	for _, cfg := range []SinkConfig{
+		{Type: "kafka"},
+		{Type: SinkSyslog, Address: "tcp://localhost:514"},
+		{Type: SinkSyslog, Address: "udp://localhost:514", Facility: "nope"},
+	} {
+		if _, err := NewSink(cfg); err == nil {
+			t.Errorf("NewSink(%+v) should fail", cfg)
+		}
+	}
+}
+
+// blockingSink hangs in WriteLine until release is closed.
+type blockingSink struct {
+	release chan struct{}
+	lines   chan string
+	closed  bool
+}
+
+func (s *blockingSink) WriteLine(t time.Time, task, stream string, pid int, msg []byte) error {
+	<-s.release
+	s.lines <- string(msg)
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSinkQueue(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{}), lines: make(chan string, sinkBuffer+2)}
+	q := newSinkQueue(sink)
+
+	// a hanging sink holds up neither the task nor its lines
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		msg := []byte("first")
+		for i := 0; i < sinkBuffer+2; i++ {
+			_ = q.WriteLine(sinkTime, "web", Stdout, 42, msg)
+			msg[0] = 'F'
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing to a hanging sink blocks")
+	}
+
+	close(sink.release)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !sink.closed {
+		t.Error("sink is not closed")
+	}
+	// the sink may have taken one line before the queue was full
+	if n := len(sink.lines); n != sinkBuffer && n != sinkBuffer+1 {
+		t.Errorf("sink got %d lines, want the %d queued", n, sinkBuffer)
+	}
+	if line := <-sink.lines; line != "first" {
+		t.Errorf("got line %q, the queue keeps no copy", line)
+	}
+	if err := q.WriteLine(sinkTime, "web", Stdout, 42, []byte("late")); err == nil {
+		t.Error("closed queue accepted a line")
+	}
+}
+
+func TestSinkDown(t *testing.T) {
+	path, _, cleanup := listenUnixgram(t)
+	sink, err := NewSink(SinkConfig{Type: SinkJournald, Address: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	cleanup()
+
+	if err := sink.WriteLine(sinkTime, "web", Stdout, 42, []byte("lost")); err == nil {
+		t.Fatal("write to a missing socket succeeded")
+	}
+	// the sink is not dialed again for every line while it is down
+	begin := time.Now()
+	for i := 0; i < 1000; i++ {
+		_ = sink.WriteLine(sinkTime, "web", Stdout, 42, []byte("lost"))
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("writing to a sink that is down took %s", took)
+	}
+}
+
+// closeSink fails to close with err.
+type closeSink struct {
+	err    error
+	closed bool
+}
+
+func (s *closeSink) WriteLine(t time.Time, task, stream string, pid int, msg []byte) error {
+	return nil
+}
+
+func (s *closeSink) Close() error {
+	s.closed = true
+	return s.err
+}
+
+func TestLoggerCloseSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logging, err := NewLogging("web", dir, DefaultLogConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := &closeSink{err: errors.New("sink failed")}
+	other := &closeSink{}
+	logging.Sinks = []LogSink{failing, other}
+	if err := logging.Close(); err != failing.err {
+		t.Errorf("got error %v, want %v", err, failing.err)
+	}
+	if !other.closed {
+		t.Error("sink after a failing one is not closed")
+	}
+}
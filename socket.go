@@ -1,134 +1,593 @@
 package spm
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
-// unix socket for communicating between cli apps and running daemon.
+// SocketPath is the unix socket for communicating between cli apps and the
+// running daemon.
+var SocketPath = "/tmp/spm01.sock"
 
-var sockName = "/tmp/spm01.sock"
-
-type Socket struct {
-	// Message emits incoming messages from dialer or listener.
-	Message chan Message
-
-	// conn is a dialer when Socket is a dialer
+// Conn is a connection between a client and the daemon. Requests and
+// responses are JSON values one after another, after an exchange of Hello.
+type Conn struct {
 	conn net.Conn
+	dec  *json.Decoder
+	role string // of the client, set by Serve
 
-	// ln is a listener when Socket is a listener.
-	ln net.Listener
-
-	// Connection emits connected dialers when Socket is a listener.
-	Connection chan *Socket
+	wmu sync.Mutex // serializes writes
+	enc *json.Encoder
 
 	mu sync.Mutex // protects following
-	// Connections holds connected dialers when Socket is a listener.
-	Connections []*Socket
+	// nextID and pending keep track of the requests of a client.
+	nextID  uint64
+	pending map[uint64]chan Response
+	// stalled are the requests that were dropped for not taking their
+	// responses
+	stalled map[uint64]bool
+	err     error // why reading responses ended
+}
+
+func newConn(c net.Conn) *Conn {
+	return &Conn{
+		conn:    c,
+		dec:     json.NewDecoder(c),
+		enc:     json.NewEncoder(c),
+		pending: make(map[uint64]chan Response),
+		stalled: make(map[uint64]bool),
+	}
+}
+
+func (c *Conn) send(v interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.enc.Encode(v)
 }
 
-type Message struct {
-	// Command can be "empty", start, stop and etc.
-	Command   string
-	Arguments []string
-	Jobs      []Task
-	JobList   []string
-	JobLogs   []string
+func (c *Conn) Close() error {
+	return c.conn.Close()
 }
 
-func (s *Socket) Send(m Message) error {
-	enc := json.NewEncoder(s.conn)
-	return enc.Encode(m)
+// Dial connects to the daemon and makes sure it speaks the same protocol.
+func Dial() (*Conn, error) {
+	return DialContext(context.Background())
 }
 
-func NewSocket() *Socket {
-	return &Socket{
-		Message:    make(chan Message, 0),
-		Connection: make(chan *Socket, 0),
+// DialContext is Dial with a context that bounds connecting and the
+// exchange of Hello.
+func DialContext(ctx context.Context) (*Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "unix", SocketPath)
+	if err != nil {
+		return nil, err
 	}
+	return handshake(ctx, nc)
 }
 
-func (s *Socket) Close() error {
-	if s.conn != nil {
-		return s.conn.Close()
+// DialTLS connects to a remote daemon listening on the TCP address addr,
+// cfg carries the client certificate for mutual TLS. An empty ServerName in
+// cfg is the host of addr.
+func DialTLS(ctx context.Context, addr string, cfg *tls.Config) (*Conn, error) {
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
 	}
+	return handshake(ctx, tls.Client(nc, cfg))
+}
 
-	if s.ln != nil {
-		if err := s.ln.Close(); err != nil {
-			return err
+// handshake exchanges Hello with the daemon on nc.
+func handshake(ctx context.Context, nc net.Conn) (*Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+		defer nc.SetDeadline(time.Time{})
+	}
+	c := newConn(nc)
+	if err := c.send(Hello{Protocol: ProtocolVersion, Version: Version}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	var hello Hello
+	if err := c.dec.Decode(&hello); err != nil {
+		c.Close()
+		if err == io.EOF {
+			// daemons of the first protocol hang up on a Hello
+			return nil, &Error{Code: CodeVersionMismatch, Message: "daemon closed the connection, it probably is older than the client, restart it"}
 		}
-		s.mu.Lock()
-		for _, sock := range s.Connections {
-			if err := sock.Close();err != nil {
-				log.Println("close sock error: ",err)
-			}
+		return nil, err
+	}
+	if hello.Protocol != ProtocolVersion {
+		c.Close()
+		msg := hello.Error
+		if msg == "" {
+			msg = versionMismatch(ProtocolVersion, hello.Protocol)
 		}
-		s.mu.Unlock()
+		return nil, &Error{Code: CodeVersionMismatch, Message: msg}
+	}
+	if hello.Error != "" {
+		c.Close()
+		return nil, &Error{Code: CodeForbidden, Message: hello.Error}
 	}
+	go c.readResponses()
+	return c, nil
+}
 
-	return nil
+func versionMismatch(client, daemon int) string {
+	return fmt.Sprintf("client speaks protocol %d but daemon speaks %d, use client and daemon of the same version", client, daemon)
 }
 
-func (s *Socket) readLoop(parent *Socket) {
-	if parent != nil {
-		parent.mu.Lock()
-		parent.Connections = append(parent.Connections, s)
-		parent.mu.Unlock()
+// readResponses hands the responses to the requests waiting for them.
+func (c *Conn) readResponses() {
+	for {
+		var res Response
+		if err := c.dec.Decode(&res); err != nil {
+			c.mu.Lock()
+			c.err = err
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[res.ID]
+		c.mu.Unlock()
+		// responses to forgotten requests, e.g. canceled ones, are dropped
+		if ch != nil {
+			c.deliver(res.ID, ch, res)
+		}
 	}
+}
+
+// stallTimeout is how long the responses of a connection wait for a request
+// that doesn't take its responses before the request is dropped.
+var stallTimeout = 5 * time.Second
 
-	dec := json.NewDecoder(s.conn)
+// deliver hands res to ch, the channel of request id. While it waits, the
+// responses to all requests on c wait, so a request that doesn't take its
+// responses for stallTimeout is dropped, unless it is the only one.
+func (c *Conn) deliver(id uint64, ch chan Response, res Response) {
+	select {
+	case ch <- res:
+		return
+	default:
+	}
+	t := time.NewTicker(stallTimeout)
+	defer t.Stop()
 	for {
-		var mes Message
-		if err := dec.Decode(&mes); err != nil {
-			if parent != nil {
-				parent.mu.Lock()
-				for i, conn := range parent.Connections {
-					if conn == s {
-						close(conn.Message)
-						parent.Connections = append(parent.Connections[:i], parent.Connections[i+1:]...)
-						break
-					}
-				}
-				parent.mu.Unlock()
-			} else {
-				close(s.Message)
-				close(s.Connection)
-			}
+		select {
+		case ch <- res:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		if c.pending[id] != ch {
+			// forgotten meanwhile
+			c.mu.Unlock()
+			return
+		}
+		if len(c.pending) > 1 {
+			delete(c.pending, id)
+			c.stalled[id] = true
+			close(ch)
+			c.mu.Unlock()
 			return
 		}
-		s.Message <- mes
+		c.mu.Unlock()
 	}
 }
 
-func (s *Socket) Listen() error {
-	ln, err := net.Listen("unix", sockName)
+// ErrStalled ends a stream whose responses were not taken in time.
+var ErrStalled = errors.New("stream dropped, its responses were not read in time")
+
+// request sends a request and returns the channel its responses arrive on.
+func (c *Conn) request(method string, params interface{}) (uint64, chan Response, error) {
+	req := Request{Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Params = b
+	}
+	ch := make(chan Response, 16)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, nil, c.err
+	}
+	c.nextID++
+	req.ID = c.nextID
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+
+	if err := c.send(req); err != nil {
+		c.forget(req.ID)
+		return 0, nil, err
+	}
+	return req.ID, ch, nil
+}
+
+func (c *Conn) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	delete(c.stalled, id)
+	c.mu.Unlock()
+}
+
+// Call sends a request and decodes its result into result, which may be nil.
+func (c *Conn) Call(method string, params, result interface{}) error {
+	return c.Stream(method, params, nil, func(raw json.RawMessage) error {
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(raw, result)
+	})
+}
+
+// Stream sends a request and passes the result of every response to fn.
+// Closing cancel, or fn returning an error, cancels the request. Stream
+// returns once the last response has arrived. A request whose responses
+// pile up because fn is slow is canceled with ErrStalled when it holds up
+// other requests on c.
+func (c *Conn) Stream(method string, params interface{}, cancel <-chan struct{}, fn func(json.RawMessage) error) error {
+	id, ch, err := c.request(method, params)
 	if err != nil {
 		return err
 	}
-	s.ln = ln
+	defer c.forget(id)
 
+	var fnErr error
+	canceled := false
+	stop := func() {
+		if !canceled {
+			canceled = true
+			// the answer to the cancel itself is of no interest
+			if cid, _, err := c.request(MethodCancel, CancelParams{ID: id}); err == nil {
+				c.forget(cid)
+			}
+		}
+	}
 	for {
-		c, err := ln.Accept()
-		if err != nil {
-			return nil
+		select {
+		case res, ok := <-ch:
+			if !ok {
+				c.mu.Lock()
+				err := c.err
+				if c.stalled[id] {
+					err = ErrStalled
+				}
+				c.mu.Unlock()
+				if err == ErrStalled {
+					stop()
+				}
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if len(res.Result) > 0 && fnErr == nil {
+				if fnErr = fn(res.Result); fnErr != nil {
+					stop()
+				}
+			}
+			if res.Done {
+				if fnErr != nil {
+					return fnErr
+				}
+				if res.Error != nil {
+					return res.Error
+				}
+				return nil
+			}
+		case <-cancel:
+			cancel = nil
+			stop()
+		}
+	}
+}
+
+// Listener accepts the connections of clients to the daemon.
+type Listener struct {
+	ln net.Listener
+	// roles maps the common names of client certificates to their roles,
+	// clients on the unix socket are admins.
+	roles map[string]string
+	// Metrics, if not nil, records the served requests.
+	Metrics *RequestMetrics
+
+	mu    sync.Mutex // protects following
+	conns map[*Conn]bool
+}
+
+// Listen listens on the socket of the daemon.
+func Listen() (*Listener, error) {
+	// a crashed daemon leaves its socket file behind, remove it unless
+	// another daemon is still answering on it
+	if c, err := net.Dial("unix", SocketPath); err == nil {
+		c.Close()
+	} else if _, err := os.Stat(SocketPath); err == nil {
+		if err := os.Remove(SocketPath); err != nil {
+			return nil, err
 		}
+	}
+
+	ln, err := net.Listen("unix", SocketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, conns: make(map[*Conn]bool)}, nil
+}
+
+// ListenTLS listens on the TCP address addr for remote clients, which must
+// present a certificate that cfg verifies. roles maps the common names of
+// the certificates to roles, "*" matches every name. Clients without a
+// role are refused.
+func ListenTLS(addr string, cfg *tls.Config, roles map[string]string) (*Listener, error) {
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("listen on %s: client certificates are not verified", addr)
+	}
+	ln, err := tls.Listen("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, roles: roles, conns: make(map[*Conn]bool)}, nil
+}
 
-		sock := NewSocket()
-		sock.conn = c
-		go sock.readLoop(s)
+// Addr returns the address the listener listens on.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
 
-		s.Connection <- sock
+// role returns the role of the client on c and names the client, see
+// WithClient.
+func (l *Listener) role(c *Conn) (role, client string, err error) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		client, err := peerUser(c.conn)
+		if err != nil {
+			client = "unix"
+		}
+		return RoleAdmin, client, nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", "", err
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", "", fmt.Errorf("client %s has no certificate", tc.RemoteAddr())
+	}
+	name := certs[0].Subject.CommonName
+	client = name
+	if host, _, err := net.SplitHostPort(tc.RemoteAddr().String()); err == nil {
+		client += "@" + host
+	}
+	if role, ok := l.roles[name]; ok {
+		return role, client, nil
 	}
+	if role, ok := l.roles["*"]; ok {
+		return role, client, nil
+	}
+	return "", "", fmt.Errorf("certificate %s has no role", name)
 }
 
-func (s *Socket) Dial() error {
-	conn, err := net.Dial("unix", sockName)
+// Accept waits for the next client.
+func (l *Listener) Accept() (*Conn, error) {
+	nc, err := l.ln.Accept()
 	if err != nil {
+		return nil, err
+	}
+	c := newConn(nc)
+	l.mu.Lock()
+	l.conns[c] = true
+	l.mu.Unlock()
+	return c, nil
+}
+
+// Close stops listening and closes the connections of all clients.
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	l.mu.Lock()
+	for c := range l.conns {
+		c.Close()
+	}
+	l.mu.Unlock()
+	return err
+}
+
+// Handler serves a request, its responses are sent through res.
+type Handler func(req *Request, res *Responder)
+
+// Responder sends the responses to a request.
+type Responder struct {
+	conn   *Conn
+	id     uint64
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	finished bool
+	code     string // error code of the last response
+}
+
+// Context ends once the request is canceled or the client went away.
+func (r *Responder) Context() context.Context {
+	return r.ctx
+}
+
+// Done is closed once the request is canceled or the client went away.
+func (r *Responder) Done() <-chan struct{} {
+	return r.ctx.Done()
+}
+
+// Send sends result as one of the responses of a stream.
+func (r *Responder) Send(result interface{}) error {
+	return r.respond(result, nil, false)
+}
+
+// Finish sends the last response to the request, which carries err unless
+// it is nil. Further responses are dropped.
+func (r *Responder) Finish(result interface{}, err error) error {
+	return r.respond(result, err, true)
+}
+
+func (r *Responder) respond(result interface{}, err error, done bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finished {
+		return nil
+	}
+	r.finished = done
+	res := Response{ID: r.id, Done: done, Error: toError(err)}
+	if done && res.Error != nil {
+		r.code = res.Error.Code
+	}
+	if result != nil {
+		b, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		res.Result = b
+	}
+	return r.conn.send(res)
+}
+
+// helloTimeout is how long a client has to finish the TLS handshake and send
+// its Hello.
+var helloTimeout = 10 * time.Second
+
+// Serve answers the Hello of a client and serves its requests, each in a
+// goroutine of its own, until the client goes away.
+func (l *Listener) Serve(c *Conn, handle Handler) error {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, c)
+		l.mu.Unlock()
+		c.Close()
+	}()
+
+	// a client that connects and stays silent would hold the connection
+	_ = c.conn.SetDeadline(time.Now().Add(helloTimeout))
+	// a refused client still gets to know why in the reply to its Hello
+	role, client, roleErr := l.role(c)
+	var hello Hello
+	if err := c.dec.Decode(&hello); err != nil {
+		if roleErr != nil {
+			return roleErr
+		}
 		return err
 	}
-	s.conn = conn
-	go s.readLoop(nil)
-	return nil
+	reply := Hello{Protocol: ProtocolVersion, Version: Version}
+	if roleErr != nil {
+		reply.Error = roleErr.Error()
+		_ = c.send(reply)
+		return roleErr
+	}
+	c.role = role
+	if hello.Protocol != ProtocolVersion {
+		reply.Error = versionMismatch(hello.Protocol, ProtocolVersion)
+		_ = c.send(reply)
+		return &Error{Code: CodeVersionMismatch, Message: reply.Error}
+	}
+	if err := c.send(reply); err != nil {
+		return err
+	}
+	_ = c.conn.SetDeadline(time.Time{})
+
+	var (
+		mu       sync.Mutex
+		inFlight = make(map[uint64]*Responder)
+	)
+	defer func() {
+		mu.Lock()
+		for _, r := range inFlight {
+			r.cancel()
+		}
+		mu.Unlock()
+	}()
+	for {
+		var req Request
+		if err := c.dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		r := &Responder{conn: c, id: req.ID}
+		r.ctx, r.cancel = context.WithCancel(WithClient(context.Background(), client))
+		begin := time.Now()
+
+		if req.Method == MethodCancel {
+			var p CancelParams
+			err := req.Decode(&p)
+			if err == nil {
+				mu.Lock()
+				if canceled := inFlight[p.ID]; canceled != nil {
+					canceled.cancel()
+				}
+				mu.Unlock()
+			}
+			_ = r.Finish(nil, err)
+			r.cancel()
+			continue
+		}
+
+		if !RoleAllows(c.role, req.Method) {
+			_ = r.Finish(nil, &Error{Code: CodeForbidden, Message: fmt.Sprintf("role %s may not %s", c.role, req.Method)})
+			r.cancel()
+			l.observe(req.Method, r, begin)
+			continue
+		}
+
+		mu.Lock()
+		_, dup := inFlight[req.ID]
+		if !dup {
+			inFlight[req.ID] = r
+		}
+		mu.Unlock()
+		if dup {
+			_ = r.Finish(nil, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("request %d is still running", req.ID)})
+			r.cancel()
+			continue
+		}
+
+		go func(req Request) {
+			handle(&req, r)
+			_ = r.Finish(nil, nil)
+			r.cancel()
+			l.observe(req.Method, r, begin)
+			mu.Lock()
+			delete(inFlight, req.ID)
+			mu.Unlock()
+		}(req)
+	}
+}
+
+// observe records the finished request of method in l.Metrics.
+func (l *Listener) observe(method string, r *Responder, begin time.Time) {
+	if l.Metrics == nil {
+		return
+	}
+	r.mu.Lock()
+	code := r.code
+	r.mu.Unlock()
+	l.Metrics.Observe(method, code, time.Since(begin))
 }
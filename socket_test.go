@@ -0,0 +1,360 @@
+package spm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testListener(t *testing.T, handle Handler) (*Listener, func()) {
+	dir, err := ioutil.TempDir("", "spm-sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := SocketPath
+	SocketPath = filepath.Join(dir, "spm.sock")
+	ln, err := Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ln.Serve(c, handle)
+		}
+	}()
+	return ln, func() {
+		ln.Close()
+		SocketPath = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	_, cleanup := testListener(t, func(req *Request, res *Responder) {
+		switch req.Method {
+		case MethodList:
+			res.Finish(ListResult{Tasks: []string{"web"}}, nil)
+		case MethodStop:
+			res.Finish(nil, &NotFoundError{Task: "web", Reason: "is not running"})
+		case MethodLog:
+			// stream until canceled
+			for i := 0; ; i++ {
+				if err := res.Send(LogResult{Lines: []LogLine{{Text: "line"}}}); err != nil {
+					return
+				}
+				if i == 2 {
+					<-res.Done()
+					return
+				}
+			}
+		default:
+			res.Finish(nil, &Error{Code: CodeUnknownMethod, Message: "unknown method " + req.Method})
+		}
+	})
+	defer cleanup()
+
+	conn, err := Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var list ListResult
+	if err := conn.Call(MethodList, nil, &list); err != nil || len(list.Tasks) != 1 {
+		t.Errorf("list: %v %v", list, err)
+	}
+	err = conn.Call(MethodStop, StopParams{Tasks: []string{"web"}}, nil)
+	if e, ok := err.(*Error); !ok || e.Code != CodeNotFound {
+		t.Errorf("stop: got error %v, want code %s", err, CodeNotFound)
+	}
+	err = conn.Call("restart", nil, nil)
+	if e, ok := err.(*Error); !ok || e.Code != CodeUnknownMethod {
+		t.Errorf("restart: got error %v, want code %s", err, CodeUnknownMethod)
+	}
+
+	// a stream ends once it is canceled, while the connection stays usable
+	cancel := make(chan struct{})
+	lines := 0
+	err = conn.Stream(MethodLog, LogParams{Follow: true}, cancel, func(raw json.RawMessage) error {
+		if lines++; lines == 3 {
+			close(cancel)
+		}
+		return nil
+	})
+	if err != nil || lines != 3 {
+		t.Errorf("log: got %d lines, error %v", lines, err)
+	}
+	if err := conn.Call(MethodList, nil, &list); err != nil {
+		t.Errorf("list after stream: %v", err)
+	}
+}
+
+func TestProtocolStalledStream(t *testing.T) {
+	old := stallTimeout
+	stallTimeout = 50 * time.Millisecond
+	defer func() { stallTimeout = old }()
+	_, cleanup := testListener(t, func(req *Request, res *Responder) {
+		switch req.Method {
+		case MethodList:
+			res.Finish(ListResult{Tasks: []string{"web"}}, nil)
+		case MethodLog:
+			for {
+				if err := res.Send(LogResult{Lines: []LogLine{{Text: "line"}}}); err != nil {
+					return
+				}
+			}
+		}
+	})
+	defer cleanup()
+
+	conn, err := Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a stream that stops taking its responses holds up other requests
+	// only for a while
+	release := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- conn.Stream(MethodLog, LogParams{Follow: true}, nil, func(raw json.RawMessage) error {
+			<-release
+			return nil
+		})
+	}()
+	// the stream fills its queue, nobody else is held up yet
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		full := false
+		conn.mu.Lock()
+		for _, ch := range conn.pending {
+			full = len(ch) == cap(ch)
+		}
+		conn.mu.Unlock()
+		if full {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not fill its queue")
+		}
+	}
+	time.Sleep(2 * stallTimeout)
+	conn.mu.Lock()
+	if len(conn.stalled) > 0 {
+		t.Error("stream that holds up nobody was dropped")
+	}
+	conn.mu.Unlock()
+	list := make(chan error, 1)
+	go func() {
+		list <- conn.Call(MethodList, nil, nil)
+	}()
+	select {
+	case err := <-list:
+		if err != nil {
+			t.Errorf("list next to a stalled stream: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled stream holds up other requests")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		conn.mu.Lock()
+		stalled := len(conn.stalled)
+		conn.mu.Unlock()
+		if stalled > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream was not dropped")
+		}
+	}
+	close(release)
+	select {
+	case err := <-errc:
+		if err != ErrStalled {
+			t.Errorf("got error %v from the stalled stream, want %v", err, ErrStalled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled stream did not end")
+	}
+	if err := conn.Call(MethodList, nil, nil); err != nil {
+		t.Errorf("list after a stalled stream: %v", err)
+	}
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	_, cleanup := testListener(t, func(req *Request, res *Responder) {})
+	defer cleanup()
+
+	c, err := net.Dial("unix", SocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// a client of the first protocol sends a command right away
+	if err := json.NewEncoder(c).Encode(map[string]string{"Command": "list"}); err != nil {
+		t.Fatal(err)
+	}
+	var reply struct{ Error string }
+	if err := json.NewDecoder(c).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error == "" {
+		t.Error("old client not told about the version mismatch")
+	}
+}
+
+// testCert issues a certificate for name signed by ca, or a self-signed CA
+// if ca is nil.
+func testCert(t *testing.T, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestListenTLS(t *testing.T) {
+	ca := testCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, "127.0.0.1", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	ln, err := ListenTLS("127.0.0.1:0", server, map[string]string{"grafana": RoleViewer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ln.Serve(c, func(req *Request, res *Responder) {
+				res.Finish(ListResult{Tasks: []string{"web"}}, nil)
+			})
+		}
+	}()
+
+	dial := func(name string) (*Conn, error) {
+		cfg := &tls.Config{Certificates: []tls.Certificate{testCert(t, name, &ca)}, RootCAs: pool}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return DialTLS(ctx, ln.Addr().String(), cfg)
+	}
+	conn, err := dial("grafana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var list ListResult
+	if err := conn.Call(MethodList, nil, &list); err != nil || len(list.Tasks) != 1 {
+		t.Errorf("list: %v %v", list, err)
+	}
+	err = conn.Call(MethodStop, StopParams{}, nil)
+	if e, ok := err.(*Error); !ok || e.Code != CodeForbidden {
+		t.Errorf("stop as viewer: got error %v, want code %s", err, CodeForbidden)
+	}
+
+	_, err = dial("mallory")
+	if e, ok := err.(*Error); !ok || e.Code != CodeForbidden {
+		t.Errorf("client without role: got error %v, want code %s", err, CodeForbidden)
+	}
+
+	// certificates of other CAs are refused by TLS
+	other := testCert(t, "other", nil)
+	cfg := &tls.Config{Certificates: []tls.Certificate{testCert(t, "grafana", &other)}, RootCAs: pool}
+	if _, err := DialTLS(context.Background(), ln.Addr().String(), cfg); err == nil {
+		t.Error("certificate of another CA accepted")
+	}
+
+	if _, err := ListenTLS("127.0.0.1:0", &tls.Config{}, nil); err == nil {
+		t.Error("listening without client certificates")
+	}
+}
+
+func TestListenTLSSilentClient(t *testing.T) {
+	old := helloTimeout
+	helloTimeout = 50 * time.Millisecond
+	defer func() { helloTimeout = old }()
+
+	ca := testCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, "127.0.0.1", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	ln, err := ListenTLS("127.0.0.1:0", server, map[string]string{"*": RoleViewer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ln.Serve(c, func(req *Request, res *Responder) {})
+		}
+	}()
+
+	// a client that never starts the handshake is hung up on
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = nc.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); err == nil || ok && e.Timeout() {
+		t.Errorf("silent client was not hung up on: %v", err)
+	}
+}
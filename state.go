@@ -0,0 +1,71 @@
+package spm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Dir returns the directory spm keeps its state files in.
+func Dir() string {
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		return filepath.Join(home, ".spm")
+	}
+	return filepath.Join(os.TempDir(), "spm")
+}
+
+// DefaultStateFile is where the daemon persists the tasks it manages.
+func DefaultStateFile() string {
+	return filepath.Join(Dir(), "state.json")
+}
+
+// DefaultDumpFile is where `spm save` snapshots the running tasks.
+func DefaultDumpFile() string {
+	return filepath.Join(Dir(), "dump.json")
+}
+
+// TaskState is the persisted form of a managed task.
+type TaskState struct {
+	Task Task
+	Pid  int
+	// StartTime is the start time of Pid as reported by the kernel,
+	// it tells a re-used pid apart from the original process.
+	StartTime uint64
+}
+
+// State is the content of a state or dump file.
+type State struct {
+	Tasks []TaskState
+}
+
+// ReadState reads the state stored in filename. A missing file results in
+// an empty state.
+func ReadState(filename string) (State, error) {
+	var s State
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// WriteState atomically replaces filename with s.
+func WriteState(filename string, s State) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
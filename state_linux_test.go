@@ -0,0 +1,137 @@
+package spm
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestManagerRestore(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	m.StateFile = filepath.Join(m.LogDir, "state", "state.json")
+
+	// a process left behind by a previous daemon, writing to its FIFOs
+	// while no daemon reads them
+	stdout, wout, err := createFIFO(m.outputFIFO("live", Stdout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, werr, err := createFIFO(m.outputFIFO("live", Stderr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := exec.Command("sh", "-c", "echo early; echo oops >&2; sleep 0.5; echo late; exec sleep 30")
+	live.Stdout, live.Stderr = wout, werr
+	live.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := live.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer live.Process.Kill()
+	// the previous daemon is gone
+	for _, f := range []*os.File{stdout, wout, stderr, werr} {
+		f.Close()
+	}
+	liveStart, err := processStartTime(live.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one whose output went to a previous daemon without FIFOs
+	orphan := exec.Command("sleep", "30")
+	orphan.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer orphan.Process.Kill()
+	orphanStart, err := processStartTime(orphan.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphanDone := make(chan struct{})
+	go func() {
+		orphan.Wait()
+		close(orphanDone)
+	}()
+	// and one that ended while no daemon was running
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = WriteState(m.StateFile, State{Tasks: []TaskState{
+		{Task: Task{Name: "live", Command: live.Args, Restart: RestartOnFailure}, Pid: live.Process.Pid, StartTime: liveStart},
+		{Task: Task{Name: "orphan", Command: []string{"sleep", "30"}}, Pid: orphan.Process.Pid, StartTime: orphanStart},
+		{Task: Task{Name: "dead", Command: []string{"sleep", "30"}}, Pid: dead.Process.Pid, StartTime: liveStart},
+		// the pid is alive but belongs to another process now
+		{Task: Task{Name: "reused", Command: []string{"sleep", "30"}}, Pid: live.Process.Pid, StartTime: liveStart - 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := waitState(t, m, "live", StateRunning); s.Pid != live.Process.Pid {
+		t.Errorf("live task has pid %d, want the re-adopted %d", s.Pid, live.Process.Pid)
+	}
+	select {
+	case <-orphanDone:
+	case <-time.After(5 * time.Second):
+		t.Error("process without FIFOs was not killed")
+	}
+	for _, name := range []string{"orphan", "dead", "reused"} {
+		if s := waitState(t, m, name, StateRunning); s.Pid == 0 || s.Pid == live.Process.Pid || s.Pid == orphan.Process.Pid || s.Pid == dead.Process.Pid {
+			t.Errorf("%s task was not started again, it has pid %d", name, s.Pid)
+		}
+	}
+	s, err := ReadState(m.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tasks) != 4 {
+		t.Errorf("got %d tasks in the state file, want 4", len(s.Tasks))
+	}
+
+	// output written before and after the re-adoption is logged
+	var lines []LogLine
+	for deadline := time.Now().Add(5 * time.Second); len(lines) < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		if lines, err = m.ReadLogs(LogQuery{Tasks: []string{"live"}, Tail: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var texts []string
+	for _, line := range lines {
+		texts = append(texts, line.Stream+" "+line.Text)
+	}
+	sort.Strings(texts)
+	if want := []string{"stderr oops", "stdout early", "stdout late"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("got output %q, want %q", texts, want)
+	}
+
+	// the end of a re-adopted process is noticed without waiting for it,
+	// and as its exit status is unknown it counts as a failure
+	live.Process.Kill()
+	live.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, err := m.Status("live")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st[0].State == StateRunning && st[0].Pid != live.Process.Pid {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("live task was not restarted, it is %s with pid %d", st[0].State, st[0].Pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,37 @@
+package spm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	filename := filepath.Join(m.LogDir, "state", "state.json")
+
+	s, err := ReadState(filename)
+	if err != nil || len(s.Tasks) != 0 {
+		t.Fatalf("got state %+v, %v from a missing file", s, err)
+	}
+
+	want := State{Tasks: []TaskState{
+		{Task: Task{Name: "web", Command: []string{"http-server", "-p", "8080"}, Dir: "/srv", Env: []string{"PORT=8080"}}, Pid: 42, StartTime: 4711},
+		{Task: Task{Name: "worker", Command: []string{"worker"}, Restart: RestartAlways, Instance: 2}},
+	}}
+	if err := WriteState(filename, want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary state file is left behind")
+	}
+	got, err := ReadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got state %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,187 @@
+package spm
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// tailChunk is how much of a file is read at once when reading backwards.
+const tailChunk = 64 * 1024
+
+// readTail returns the last q.Tail lines selected by q from filename, the log
+// of task. When the file has fewer lines, reading continues into the rotated
+// backups. Memory use is bound by the number and length of the lines. The
+// returned offset is the end of the last complete line of filename.
+func readTail(filename, task string, q LogQuery) ([]LogLine, int64, error) {
+	n := q.Tail
+	var (
+		offset   int64
+		reversed []LogLine // newest first
+	)
+	selected := func(s string) bool {
+		_, ok := q.match(task, s)
+		return ok
+	}
+	collect := func(s string) bool {
+		if line, ok := q.match(task, s); ok {
+			reversed = append(reversed, line)
+		}
+		return len(reversed) < n
+	}
+
+	f, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if err == nil {
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		// an incomplete line is left to be followed
+		if offset, err = lastLineEnd(f, fi.Size()); err != nil {
+			return nil, 0, err
+		}
+		if n > 0 {
+			if err := reverseLines(f, offset, collect); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if len(reversed) < n {
+		backups, err := logBackups(filename)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i := len(backups) - 1; i >= 0 && len(reversed) < n; i-- {
+			if err := tailBackup(backups[i].name, n-len(reversed), selected, collect); err != nil && !os.IsNotExist(err) {
+				return nil, 0, err
+			}
+		}
+	}
+
+	lines := make([]LogLine, len(reversed))
+	var prev time.Time
+	for i := range reversed {
+		line := reversed[len(reversed)-1-i]
+		// lines without a time keep the order they were written in
+		if line.Time.IsZero() {
+			line.Time = prev
+		}
+		prev = line.Time
+		lines[i] = line
+	}
+	return lines, offset, nil
+}
+
+// tailBackup passes the lines of a rotated backup to fn newest first, until
+// fn returns false. Compressed backups can't be read backwards, they are
+// read through while keeping the last n lines that are selected.
+func tailBackup(name string, n int, selected, fn func(string) bool) error {
+	if !strings.HasSuffix(name, ".gz") {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return reverseLines(f, fi.Size(), fn)
+	}
+
+	r, err := openLog(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	ring := make([]string, n)
+	count := 0
+	sc := bufio.NewReader(r)
+	for {
+		s, err := sc.ReadString('\n')
+		if line := strings.TrimSuffix(s, "\n"); s != "" && selected(line) {
+			ring[count%n] = line
+			count++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for i := count - 1; i >= 0 && i >= count-n; i-- {
+		if !fn(ring[i%n]) {
+			break
+		}
+	}
+	return nil
+}
+
+// lastLineEnd returns the offset right after the last newline before size.
+func lastLineEnd(r io.ReaderAt, size int64) (int64, error) {
+	buf := make([]byte, tailChunk)
+	for end := size; end > 0; {
+		start := end - tailChunk
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := r.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// reverseLines passes the lines of r before end to fn, the last line first,
+// until fn returns false. The data before end has to end with a newline.
+func reverseLines(r io.ReaderAt, end int64, fn func(string) bool) error {
+	buf := make([]byte, tailChunk)
+	// partial holds the start of a line whose beginning has not been read
+	var partial []byte
+	for pos := end; pos > 0; {
+		start := pos - tailChunk
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:pos-start]
+		if _, err := r.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return err
+		}
+		pos = start
+
+		data := append(chunk, partial...)
+		// the trailing newline of the data ends the newest line
+		if pos+int64(len(data)) == end {
+			data = bytes.TrimSuffix(data, []byte{'\n'})
+		}
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if !fn(string(data[i+1:])) {
+				return nil
+			}
+			data = data[:i]
+		}
+		partial = append(partial[:0:0], data...)
+	}
+	if len(partial) > 0 || end > 0 {
+		fn(string(partial))
+	}
+	return nil
+}
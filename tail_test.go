@@ -0,0 +1,177 @@
+package spm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2019, 4, 18, 0, 0, 0, 0, time.UTC)
+	filename := filepath.Join(dir, "worker.log")
+	writeLog(t, filepath.Join(dir, "worker-2019-04-18T02-03-00.000.log.gz"), true, day, "a", "b", "c")
+	writeLog(t, filepath.Join(dir, "worker-2019-04-18T02-06-00.000.log"), false, day.Add(3*time.Minute), "d", "e")
+	// the active file spans several chunks and ends with an incomplete line
+	long := strings.Repeat("x", tailChunk)
+	writeLog(t, filename, false, day.Add(5*time.Minute), "f", long, "g")
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(f, "partial")
+	f.Close()
+
+	for _, test := range []struct {
+		n    int
+		want string
+	}{
+		{0, ""},
+		{1, "g"},
+		{3, "f long g"},
+		{5, "d e f long g"},
+		{7, "b c d e f long g"},
+		{20, "a b c d e f long g"},
+	} {
+		lines, offset, err := readTail(filename, "worker", LogQuery{Tail: test.n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, line := range lines {
+			if line.Text == long {
+				line.Text = "long"
+			}
+			got = append(got, line.Text)
+		}
+		if s := strings.Join(got, " "); s != test.want {
+			t.Errorf("tail %d: got %q, want %q", test.n, s, test.want)
+		}
+		fi, _ := os.Stat(filename)
+		if want := fi.Size() - int64(len("partial")); offset != want {
+			t.Errorf("tail %d: offset %d, want %d", test.n, offset, want)
+		}
+	}
+
+	lines, _, err := readTail(filepath.Join(dir, "missing.log"), "missing", LogQuery{Tail: 10})
+	if err != nil || len(lines) != 0 {
+		t.Errorf("missing file: %v %v", lines, err)
+	}
+}
+
+func TestReadTailStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spm-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the errors in the compressed backup are followed by more output
+	day := time.Date(2019, 4, 18, 0, 0, 0, 0, time.UTC)
+	var b []byte
+	for i, stream := range []string{Stderr, Stderr, Stdout, Stdout, Stdout} {
+		b = appendLogHeader(b, LogFormatRFC3339Nano, day.Add(time.Duration(i)*time.Minute), "worker", stream)
+		b = append(append(b, fmt.Sprintf("%s%d", stream, i)...), '\n')
+	}
+	var z bytes.Buffer
+	w := gzip.NewWriter(&z)
+	w.Write(b)
+	w.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "worker-2019-04-18T02-03-00.000.log.gz"), z.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "worker.log")
+	writeLog(t, filename, false, day.Add(5*time.Minute), "stdout5")
+
+	lines, _, err := readTail(filename, "worker", LogQuery{Tail: 2, Stream: Stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range lines {
+		got = append(got, line.Text)
+	}
+	if s := strings.Join(got, " "); s != "stderr0 stderr1" {
+		t.Errorf("got stderr lines %q, want %q", s, "stderr0 stderr1")
+	}
+}
+
+func TestManagerFollowLogs(t *testing.T) {
+	m, _, cleanup := testManager(t)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the task prints a line whenever a file named after it appears
+	next := filepath.Join(m.LogDir, "next")
+	script := "echo one; for line in two three; do while [ ! -f %[1]s ]; do sleep 0.01; done; rm %[1]s; echo $line; done; sleep 30"
+	task := Task{Name: "web", Command: []string{"sh", "-c", fmt.Sprintf(script, next)}}
+	if err := m.Start(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		lines, err := m.ReadLogs(LogQuery{Tasks: []string{"web"}, Tail: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) == 1 || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	lines := make(chan string, 10)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.FollowLogs(ctx, LogQuery{Tasks: []string{"web"}, Tail: 1}, func(line LogLine) error {
+			lines <- line.Text
+			return nil
+		})
+	}()
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("got line %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no line %q", want)
+		}
+	}
+	expect("one")
+	if err := ioutil.WriteFile(next, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("two")
+
+	// following goes on in the new file after a rotation
+	if err := m.Rotate("web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(next, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("three")
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("following did not end with its context")
+	}
+}
@@ -1,16 +1,18 @@
 package spm
 
 import (
-	"os/exec"
+	"fmt"
+	"strconv"
+	"strings"
 )
 
 type Task struct {
 	Name    string
 	Command []string
-	Logger  *Logger
 
-	NotifyEnd chan bool `json:"-"`
-	Cmd       *exec.Cmd `json:"-"`
+	// Procfile is the absolute path of the file the task was parsed from,
+	// kept so that the task can be reloaded later.
+	Procfile string
 
 	Chroot string
 	Dir string
@@ -18,8 +20,76 @@ type Task struct {
 	Group string
 	Env   []string
 	Need [][]string
+	// Ready is a command that succeeds once the task is ready to serve.
+	Ready []string
+
+	// Log configures the log file, nil uses DefaultLogConfig.
+	Log *LogConfig
+	// LogFormat is the time format of log lines, empty uses the daemon's.
+	LogFormat string
+	// LogOutput is the encoding of log lines, empty uses the daemon's.
+	LogOutput string
+	// LogSinks forward the output to syslog or journald as well.
+	LogSinks []SinkConfig
+	// LogFilters process the output before it is logged, in order.
+	LogFilters []FilterConfig
+
+	// Critical tasks take the daemon down with them when they end.
+	Critical bool
+	// Restart is the restart policy, one of the Restart constants. Empty
+	// never restarts.
+	Restart string
+	// MaxRestarts is the number of restarts in a row after which the task
+	// fails, zero restarts it forever.
+	MaxRestarts int
+	// Instance is the number of a copy started by Manager.Scale, zero for
+	// the task itself.
+	Instance int `json:",omitempty"`
 }
 
 func (t Task)Valid() bool  {
 	return t.Name != "" && len(t.Command) > 0
-}
\ No newline at end of file
+}
+
+func (t Task) logConfig() LogConfig {
+	if t.Log != nil {
+		return *t.Log
+	}
+	return DefaultLogConfig()
+}
+
+// instanceName returns the name of instance i of the task named name.
+func instanceName(name string, i int) string {
+	if i <= 1 {
+		return name
+	}
+	return fmt.Sprintf("%s.%d", name, i)
+}
+
+// instanceOf returns the instance number of the task named name if it is
+// an instance of base, or zero.
+func instanceOf(name, base string) int {
+	if name == base {
+		return 1
+	}
+	if !strings.HasPrefix(name, base+".") {
+		return 0
+	}
+	i, err := strconv.Atoi(name[len(base)+1:])
+	if err != nil || i < 2 {
+		return 0
+	}
+	return i
+}
+
+// instance returns instance i of the task, which knows its number from
+// SPM_INSTANCE.
+func (t Task) instance(i int) Task {
+	if i <= 1 {
+		return t
+	}
+	t.Name = instanceName(t.Name, i)
+	t.Instance = i
+	t.Env = append(append([]string(nil), t.Env...), fmt.Sprintf("SPM_INSTANCE=%d", i))
+	return t
+}